@@ -0,0 +1,217 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const cacheVersion = 1
+
+// A Cache stores the partial hashes of files across runs so that unchanged
+// files need not be read again. Files are identified by their absolute path;
+// an entry is invalidated when the size, the modification time or the inode
+// of the file change.
+//
+// A Cache is safe for concurrent use.
+type Cache struct {
+	hash string
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	seen    map[string]bool
+
+	hits, misses int64
+}
+
+// cacheEntry holds the digests of a file for every checksum roll computed so
+// far: Sums[i] is the partial hash at 'pos==i+1'. State is the marshaled
+// digest at 'pos==len(Sums)', if the hash algorithm supports it.
+type cacheEntry struct {
+	Size    int64
+	ModTime int64
+	Inode   uint64
+	Sums    [][]byte
+	State   []byte
+
+	c *Cache
+}
+
+// cacheFile is the on-disk format of a Cache.
+type cacheFile struct {
+	Version int
+	Hash    string
+	Entries map[string]*cacheEntry
+}
+
+// NewCache returns an empty cache for the checksum algorithm 'hashName'.
+func NewCache(hashName string) *Cache {
+	return &Cache{
+		hash:    hashName,
+		entries: make(map[string]*cacheEntry),
+		seen:    make(map[string]bool),
+	}
+}
+
+// LoadCache reads the cache stored at 'path'. The cache is empty if the file
+// does not exist or if it was computed with another checksum algorithm. A
+// corrupted file is reported in the error, while the returned cache is still
+// usable: it is empty.
+func LoadCache(path, hashName string) (*Cache, error) {
+	c := NewCache(hashName)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return c, err
+	}
+	defer f.Close()
+
+	var cf cacheFile
+	err = gob.NewDecoder(f).Decode(&cf)
+	if err != nil {
+		return c, fmt.Errorf("corrupted cache '%v': %v", path, err)
+	}
+	if cf.Version != cacheVersion || cf.Hash != hashName {
+		return c, nil
+	}
+
+	// Drop the entries that would be inconsistent with the hash algorithm.
+	size := 0
+	if newHash, err := lookupHash(hashName); err == nil {
+		size = newHash().Size()
+	}
+	for path, e := range cf.Entries {
+		if e == nil || !filepath.IsAbs(path) {
+			continue
+		}
+		valid := true
+		for _, sum := range e.Sums {
+			if len(sum) != size {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			e.c = c
+			c.entries[path] = e
+		}
+	}
+	return c, nil
+}
+
+// Save writes the cache to 'path' atomically. Entries of files that were not
+// visited since the cache was loaded are kept only if the files are unchanged.
+func (c *Cache) Save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cf := cacheFile{Version: cacheVersion, Hash: c.hash, Entries: make(map[string]*cacheEntry)}
+	for p, e := range c.entries {
+		if len(e.Sums) == 0 {
+			continue
+		}
+		if !c.seen[p] {
+			info, err := os.Lstat(p)
+			if err != nil || !e.valid(info) {
+				continue
+			}
+		}
+		cf.Entries[p] = e
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&cf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Stats returns the number of checksum rolls served from the cache and the
+// number of rolls that required reading the file.
+func (c *Cache) Stats() (hits, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+func (e *cacheEntry) valid(info os.FileInfo) bool {
+	_, ino, _ := fileIdentity(info)
+	return e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() && e.Inode == ino
+}
+
+// entry returns the cache entry of the file at 'path'. A new entry replaces
+// the existing one if the latter is stale.
+func (c *Cache) entry(path string, info os.FileInfo) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[path] = true
+	e, ok := c.entries[path]
+	if ok && e.valid(info) {
+		return e
+	}
+	_, ino, _ := fileIdentity(info)
+	e = &cacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Inode: ino, c: c}
+	c.entries[path] = e
+	return e
+}
+
+// sum returns the cached partial hash at 'pos+1', if any. The lookup is
+// counted as a roll in the Stats.
+func (e *cacheEntry) sum(pos int64) ([]byte, bool) {
+	sum, ok := e.lookup(pos)
+	if ok {
+		atomic.AddInt64(&e.c.hits, 1)
+	} else {
+		atomic.AddInt64(&e.c.misses, 1)
+	}
+	return sum, ok
+}
+
+// lookup is like sum, but it is not counted in the Stats.
+func (e *cacheEntry) lookup(pos int64) ([]byte, bool) {
+	e.c.mu.Lock()
+	defer e.c.mu.Unlock()
+	if pos < int64(len(e.Sums)) {
+		return e.Sums[pos], true
+	}
+	return nil, false
+}
+
+// restore sets the state of 'h' to the cached digest at 'pos'. It reports
+// whether it succeeded.
+func (e *cacheEntry) restore(h hash.Hash, pos int64) bool {
+	e.c.mu.Lock()
+	defer e.c.mu.Unlock()
+	return pos == int64(len(e.Sums)) && unmarshalState(h, e.State)
+}
+
+// record stores 'sum', the partial hash at 'pos+1', together with the state of
+// the digest. Only the next missing roll is recorded.
+func (e *cacheEntry) record(pos int64, sum, state []byte) {
+	e.c.mu.Lock()
+	defer e.c.mu.Unlock()
+	if pos == int64(len(e.Sums)) {
+		e.Sums = append(e.Sums, sum)
+		e.State = state
+	}
+}
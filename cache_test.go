@@ -0,0 +1,100 @@
+package hsync
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "cache")
+
+	var plans []Plan
+	for run := 0; run < 2; run++ {
+		c, err := LoadCache(cachePath, DefaultHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		a.Cache = c
+		if err := a.VisitSource("./testdata/src"); err != nil {
+			t.Fatal(err)
+		}
+		p, err := a.Analyze("./testdata/tgt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plans = append(plans, p)
+		if err := c.Save(cachePath); err != nil {
+			t.Fatal(err)
+		}
+
+		hits, misses := c.Stats()
+		if run == 0 && (hits != 0 || misses == 0) {
+			t.Errorf("First run: got %v hits and %v misses, want only misses", hits, misses)
+		}
+		if run == 1 && (hits == 0 || misses != 0) {
+			t.Errorf("Second run: got %v hits and %v misses, want only hits", hits, misses)
+		}
+	}
+
+	if !reflect.DeepEqual(plans[0], plans[1]) {
+		t.Errorf("Cached plan %v differs from uncached plan %v", plans[1], plans[0])
+	}
+
+	if err := ioutil.WriteFile(cachePath, []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadCache(cachePath, DefaultHash)
+	if err == nil {
+		t.Error("Corrupted cache should be reported")
+	}
+	if c == nil || len(c.entries) != 0 {
+		t.Error("Corrupted cache should be loaded empty")
+	}
+
+	c, err = LoadCache(filepath.Join(dir, "nonexisting"), DefaultHash)
+	if err != nil || c == nil {
+		t.Errorf("Non-existing cache should be loaded empty, got error %v", err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := LoadCache(filepath.Join(dir, "cache"), DefaultHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := c.entry("file", info)
+	e.record(0, []byte("sum"), nil)
+
+	// Fingerprints are looked up without being counted as rolls.
+	if _, ok := e.lookup(0); !ok {
+		t.Error("Got no cached sum")
+	}
+	if hits, misses := c.Stats(); hits != 0 || misses != 0 {
+		t.Errorf("After a lookup: got %v hits and %v misses, want none", hits, misses)
+	}
+	e.sum(0)
+	e.sum(1)
+	if hits, misses := c.Stats(); hits != 1 || misses != 1 {
+		t.Errorf("After two rolls: got %v hits and %v misses, want 1 and 1", hits, misses)
+	}
+}
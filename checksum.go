@@ -0,0 +1,61 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// DefaultHash is the checksum algorithm used when none is specified.
+const DefaultHash = "md5"
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// The registry of checksum algorithms usable for partial hashes. Cryptographic
+// algorithms have fewer collisions while the non-cryptographic ones are faster.
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"blake2b": func() hash.Hash {
+		// Only fails on invalid key.
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	"crc64":  func() hash.Hash { return crc64.New(crc64Table) },
+	"xxhash": func() hash.Hash { return newXXHash64() },
+}
+
+// RegisterHash makes a checksum algorithm available under 'name'. It replaces
+// any algorithm previously registered with the same name.
+// RegisterHash is not safe for concurrent use with the analysis.
+func RegisterHash(name string, newHash func() hash.Hash) {
+	hashes[name] = newHash
+}
+
+// Hashes returns the sorted names of the registered checksum algorithms.
+func Hashes() []string {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupHash(name string) (func() hash.Hash, error) {
+	newHash, ok := hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm '%v'", name)
+	}
+	return newHash, nil
+}
@@ -0,0 +1,39 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+/*
+Hsync is a filesystem hierarchy synchronizer.
+
+Rename files in TARGET so that identical files found in SOURCE and TARGET have
+the same relative path.
+
+The main goal of the program is to make folders synchronization faster by
+sparing big file transfers when a simple rename suffices. It complements other
+synchronization programs that lack this capability.
+
+See http://ambrevar.bitbucket.io/hsync and 'hsync -h' for more details.
+
+Usage:
+
+	hsync [OPTIONS] SOURCE TARGET...
+
+The analysis and the renames can be run separately:
+
+	hsync analyze [OPTIONS] SOURCE TARGET... -o PREVIEW
+	hsync apply [OPTIONS] PREVIEW [TARGET...]
+	hsync check PREVIEW...
+
+When SOURCE or TARGET is not reachable, its manifest can be passed instead:
+
+	hsync manifest [OPTIONS] DIR -o MANIFEST
+
+SOURCE can also be a checksum list such as 'SHA256SUMS'.
+
+For usage options, see:
+
+	hsync -h
+
+The analysis and the renames are implemented in the hsync package, see
+github.com/ambrevar/hsync.
+*/
+package main
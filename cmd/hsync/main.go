@@ -0,0 +1,873 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ambrevar/hsync"
+)
+
+const (
+	application = "hsync"
+	copyright   = "Copyright (C) 2015-2016 Pierre Neidhardt"
+)
+
+var version = "<tip>"
+
+const usage = `Filesystem hierarchy synchronizer
+
+Rename files in TARGET so that identical files found in SOURCE and TARGET have
+the same relative path.
+
+Several TARGET folders can be given: SOURCE is analyzed only once and one plan
+is produced for every TARGET.
+
+The main goal of the program is to make folders synchronization faster by
+sparing big file transfers when a simple rename suffices. It complements other
+synchronization programs that lack this capability.
+
+By default, files are not renamed and a preview is printed to standard output.
+
+False positives can happen, e.g. if two different files in SOURCE and TARGET are
+the only ones of this size. Use the preview to spot false positives and make sure
+all files get renamed properly. Alternatively, '-verify' compares the whole
+content of the matches and rejects the false positives, at the cost of reading
+all matching files.
+
+The preview lists every rename with the size of the file, the number of blocks
+hashed ('pos'), the partial hash and a confidence: 'verified' if the content was
+compared, 'full' if the whole file was hashed, 'partial' if only its beginning
+was, 'size' if only the sizes were compared. The latter are the most likely
+false positives. It also records the fingerprint of every TARGET file, i.e. the
+digest of its first block: before renaming, files whose size, fingerprint or
+partial hash changed since the analysis are skipped and reported, and so are
+the folder renames containing such files.
+
+You can redirect the preview to a file. If you run the program using this
+preview file as SOURCE, the analysis will be skipped. This is useful if you want
+to tweak the result of the analysis: edit 'new' or remove entries. Previews of
+former versions are accepted. If the preview holds several plans, they are
+applied to the TARGET folders in order. The preview records the checksum
+algorithm of the analysis: if '-hash' is passed as well, both must agree.
+
+The analysis and the renames can also be run as separate commands, each with
+its own options and help: 'analyze' writes the preview, to a file with '-o',
+and 'apply' processes it, e.g.
+
+	hsync analyze SOURCE TARGET -o preview.json
+	hsync apply preview.json TARGET
+
+'check' validates previews. Use './analyze' and the like to refer to a SOURCE
+folder named after a command.
+
+When SOURCE or TARGET is not reachable, e.g. on another machine, 'manifest'
+writes the list of the files of a folder with their size and partial hash. The
+manifest can be passed as SOURCE or TARGET in place of the folder, e.g.
+
+	hsync manifest -o source.json SOURCE
+	hsync analyze source.json TARGET -o preview.json
+
+The local files are hashed to the depths recorded in the manifest: files that
+cannot be told apart at that depth are skipped, see '-depth'. The plan of a
+TARGET manifest is to be applied where its folder is, with 'apply'. The
+manifest records its checksum algorithm, which is used unless '-hash' is
+passed. Manifests do not support '-verify' and do not list symbolic links: a
+TARGET manifest does not support '-folders', '-symlinks' and '-relocate-links'
+either.
+
+SOURCE can also be a checksum list as written by md5sum, sha1sum or sha256sum,
+or by their BSD counterparts with '--tag', e.g. the 'SHA256SUMS' of an archive.
+The listed paths are relative to SOURCE. TARGET files are matched by the digest
+of their whole content, so they are all read completely, unless they are in the
+cache. The checksum algorithm is guessed from the list unless '-hash' is
+passed.
+
+With '-folders', when all the files of a TARGET folder move to the same new
+folder with the same layout, the folder is renamed instead of every file. The
+preview marks such renames with '"folder": true'. Folders holding files that
+would not be renamed otherwise are not collapsed.
+
+With '-symlinks', symbolic links are matched by their target, as a string, and
+renamed like files. With '-relocate-links', links with a relative target are
+matched by the path they point to instead, even if the file it points to is
+renamed as well, and their target is rewritten after the rename so that they
+keep pointing to it. Links with duplicates are skipped.
+
+Symbolic links to folders are not walked, unless '-follow' is set. The files
+found through a link keep the path they have in SOURCE or TARGET, so they are
+renamed through the link; the preview records the real path of such TARGET files
+('real'). Links leading back to a folder being walked are skipped, and so are
+the links of TARGET leading out of it: the files found there could not be
+renamed within TARGET, and plans renaming through such links are invalid. Note
+that renames across filesystems fail: with '-one-file-system', the folders on
+another filesystem than SOURCE or TARGET, such as mount points, are not walked.
+
+With '-prune', the folders left empty by the renames are removed. Folders that
+were empty before are left alone.
+
+With '-journal', the processed renames are appended to a journal. The 'undo'
+command replays journals in reverse to restore the original layout, pruned
+folders included.
+
+The journal also records the plan before the renames start. If a run gets
+interrupted, '-resume JOURNAL' completes the remaining renames, including the
+pending steps of chains and cycles; with '-rollback', the processed renames of
+the interrupted run are reverted instead. Temporary files left empty are
+removed in both cases. SOURCE and TARGET are not needed.
+
+Files can be filtered with '-include' and '-exclude'. Patterns follow the
+.gitignore syntax, e.g. '*.jpg', '/photos/**/raw' or 'cache/', and are relative
+to SOURCE and TARGET. Every folder may also contain a '.hsyncignore' file with
+one pattern per line that applies to its content. Excluded folders are not
+walked.
+
+Small files are cheap to transfer and make most of the duplicates: skip them
+with '-min-size'. Sizes accept the units K, M, G and T (powers of 1024), e.g.
+'10M'. The thresholds are recorded in the preview.
+
+Preview files are validated before any rename happens: paths must be relative
+and stay inside TARGET, and two files cannot be renamed to the same path. Every
+problem is reported with its entry. 'check PREVIEW...' only validates.
+
+Notes:
+- Duplicate files in either folder are skipped, unless '-dup' is set. Then
+duplicates are paired so that as few files as possible get renamed. If the
+number of duplicates differ, the remaining files are reported.
+- TARGET folders that are SOURCE folders at the same path, e.g. through a bind
+mount, are not walked: their files are in place.
+- Only regular files are processed, and symbolic links with '-symlinks'. In
+particular, empty folders are ignored.`
+
+func init() {
+	log.SetFlags(0)
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// sizeFlag is a size in bytes. Values are non-negative integers or decimals
+// followed by an optional unit: 'B', or K, M, G, T, possibly followed by 'B' or
+// 'iB'. Units are powers of 1024.
+type sizeFlag int64
+
+func (f *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*f), 10)
+}
+
+func (f *sizeFlag) Set(s string) error {
+	num := s[:len(s)-len(strings.TrimLeft(s, "0123456789."))]
+	unit := s[len(num):]
+	scale := 1.0
+	if unit != "" && unit != "B" {
+		exp := strings.IndexByte("KMGT", strings.ToUpper(unit[:1])[0])
+		if suffix := unit[1:]; exp < 0 || suffix != "" && suffix != "B" && suffix != "iB" {
+			return fmt.Errorf("invalid unit in '%v'", s)
+		}
+		scale = float64(int64(1) << uint(10*(exp+1)))
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size '%v'", s)
+	}
+	// Sizes from 2^63 bytes overflow.
+	size := n * scale
+	if math.IsNaN(size) || math.IsInf(size, 0) || size < 0 || size >= 1<<63 {
+		return fmt.Errorf("size out of range '%v'", s)
+	}
+	*f = sizeFlag(size)
+	return nil
+}
+
+// flagIsSet reports whether the flag 'name' of 'fs' was passed on the command
+// line.
+func flagIsSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// parseArgs parses 'args' with 'fs' and returns the positional arguments.
+// Flags may follow positional arguments, as in 'hsync analyze SOURCE TARGET -o
+// PREVIEW'. The arguments after '--' are all positional.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		// Failure exits since the flag sets use flag.ExitOnError.
+		_ = fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// walkFlags are the options of the walks.
+type walkFlags struct {
+	cache            string
+	exclude          stringList
+	follow           bool
+	hash             string
+	include          stringList
+	jobs             int
+	maxSize, minSize sizeFlag
+	oneFileSystem    bool
+	fs               *flag.FlagSet
+}
+
+func (wf *walkFlags) register(fs *flag.FlagSet) {
+	wf.fs = fs
+	fs.StringVar(&wf.cache, "cache", "", "Store the partial hashes in this file to speed up subsequent runs.")
+	fs.Var(&wf.exclude, "exclude", "Skip files and folders matching this pattern. Can be repeated.")
+	fs.BoolVar(&wf.follow, "follow", false, "Walk the folders pointed to by symbolic links.")
+	fs.StringVar(&wf.hash, "hash", hsync.DefaultHash, "Checksum algorithm used for the analysis: "+strings.Join(hsync.Hashes(), ", ")+".")
+	fs.Var(&wf.include, "include", "Only process files matching this pattern. Can be repeated.")
+	fs.IntVar(&wf.jobs, "j", 1, "Number of files processed concurrently during the analysis.")
+	fs.Var(&wf.maxSize, "max-size", "Skip files bigger than this size, e.g. '4G'.")
+	fs.Var(&wf.minSize, "min-size", "Skip files smaller than this size, e.g. '10M'.")
+	fs.BoolVar(&wf.oneFileSystem, "one-file-system", false, "Skip the folders on other filesystems, such as mount points.")
+}
+
+// checkSizes returns an error if the size thresholds skip every file.
+func (wf *walkFlags) checkSizes() error {
+	if wf.minSize > 0 && wf.maxSize > 0 && wf.minSize > wf.maxSize {
+		return fmt.Errorf("-min-size %v is greater than -max-size %v", int64(wf.minSize), int64(wf.maxSize))
+	}
+	return nil
+}
+
+// analyzer returns an Analyzer set up with the options. The first non-empty
+// hash of 'hashes', as recorded in manifests and checksum lists, is used
+// unless '-hash' is passed. Invalid options are a usage error.
+func (wf *walkFlags) analyzer(hashes ...string) *hsync.Analyzer {
+	if err := wf.checkSizes(); err != nil {
+		fmt.Fprintln(wf.fs.Output(), err)
+		wf.fs.Usage()
+		os.Exit(2)
+	}
+	if !flagIsSet(wf.fs, "hash") {
+		for _, hash := range hashes {
+			if hash != "" {
+				wf.hash = hash
+				break
+			}
+		}
+	}
+	a := hsync.NewAnalyzer()
+	a.Hash = wf.hash
+	a.Jobs = wf.jobs
+	a.Follow = wf.follow
+	a.OneFileSystem = wf.oneFileSystem
+	a.Include = wf.include
+	a.Exclude = wf.exclude
+	a.MinSize = int64(wf.minSize)
+	a.MaxSize = int64(wf.maxSize)
+	if wf.cache != "" {
+		// The cache is usable even if it could not be loaded.
+		var err error
+		a.Cache, err = hsync.LoadCache(wf.cache, wf.hash)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return a
+}
+
+// saveCache saves the cache of 'a', if any.
+func (wf *walkFlags) saveCache(a *hsync.Analyzer) {
+	if a.Cache == nil {
+		return
+	}
+	hits, misses := a.Cache.Stats()
+	log.Printf(":: Cache: %v hits, %v misses", hits, misses)
+	err := a.Cache.Save(wf.cache)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// analysisFlags are the options of the analysis.
+type analysisFlags struct {
+	walkFlags
+	duplicates    bool
+	folders       bool
+	relocateLinks bool
+	symlinks      bool
+	verify        bool
+}
+
+func (af *analysisFlags) register(fs *flag.FlagSet) {
+	af.walkFlags.register(fs)
+	fs.BoolVar(&af.duplicates, "dup", false, "Pair duplicate files instead of skipping them.")
+	fs.BoolVar(&af.folders, "folders", false, "Rename whole folders when all their files move together.")
+	fs.BoolVar(&af.relocateLinks, "relocate-links", false, "Match relative symbolic links by the path they resolve to and rewrite them when renamed. Implies '-symlinks'.")
+	fs.BoolVar(&af.symlinks, "symlinks", false, "Match symbolic links by their target.")
+	fs.BoolVar(&af.verify, "verify", false, "Compare the whole content of matching files to discard false positives.")
+}
+
+// readManifest returns the manifest at 'path', or nil if 'path' is a folder or
+// a file that is not a manifest, e.g. a preview.
+func readManifest(path string) *hsync.Manifest {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return nil
+	}
+	m, err := hsync.ReadManifest(f)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// sourceList is a SOURCE given as a file listing its files: a manifest or a
+// checksum list. Both are nil if SOURCE is a folder.
+type sourceList struct {
+	manifest *hsync.Manifest
+	sums     *hsync.Checksums
+}
+
+func (l sourceList) isSet() bool {
+	return l.manifest != nil || l.sums != nil
+}
+
+func (l sourceList) hash() string {
+	switch {
+	case l.manifest != nil:
+		return l.manifest.Hash
+	case l.sums != nil:
+		return l.sums.Hash
+	}
+	return ""
+}
+
+// readSource returns the list of the SOURCE file 'path'. It is not set if
+// 'path' is a folder or neither a manifest nor a checksum list, e.g. a
+// preview.
+func readSource(path string) sourceList {
+	m := readManifest(path)
+	if m != nil {
+		return sourceList{manifest: m}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return sourceList{}
+	}
+	c, err := hsync.ReadChecksums(f)
+	if err == hsync.ErrNotChecksums {
+		return sourceList{}
+	}
+	if err != nil {
+		log.Fatalf("%v: %v", path, err)
+	}
+	return sourceList{sums: c}
+}
+
+// analyze returns the plans of the TARGET folders. SOURCE can be given by
+// 'list' and the TARGETs can be manifests.
+func (af *analysisFlags) analyze(source string, list sourceList, targets []string) []hsync.Plan {
+	targetManifests := make([]*hsync.Manifest, len(targets))
+	hashes := []string{list.hash()}
+	for i, target := range targets {
+		targetManifests[i] = readManifest(target)
+		if targetManifests[i] != nil {
+			hashes = append(hashes, targetManifests[i].Hash)
+		}
+	}
+	a := af.analyzer(hashes...)
+	a.Verify = af.verify
+	a.Duplicates = af.duplicates
+	a.Folders = af.folders
+	a.Symlinks = af.symlinks
+	a.RelocateLinks = af.relocateLinks
+	var err error
+	if list.manifest != nil {
+		log.Printf(":: Reading manifest '%v'", source)
+		err = a.VisitManifest(list.manifest)
+	} else if list.sums != nil {
+		log.Printf(":: Reading checksums '%v'", source)
+		err = a.VisitChecksums(list.sums)
+	} else {
+		log.Printf(":: Analyzing '%v'", source)
+		err = a.VisitSource(source)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	var plans []hsync.Plan
+	for i, target := range targets {
+		var plan hsync.Plan
+		if targetManifests[i] != nil {
+			log.Printf(":: Matching manifest '%v'", target)
+			plan, err = a.AnalyzeManifest(targetManifests[i])
+		} else {
+			log.Printf(":: Analyzing '%v'", target)
+			plan, err = a.Analyze(target)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		plans = append(plans, plan)
+	}
+	af.saveCache(a)
+	return plans
+}
+
+// renameFlags are the options of the renames.
+type renameFlags struct {
+	clobber bool
+	journal string
+	prune   bool
+}
+
+func (rf *renameFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&rf.clobber, "f", false, "Overwrite existing files in TARGETS.")
+	fs.StringVar(&rf.journal, "journal", "", "Record the processed renames in this file so that they can be undone.")
+	fs.BoolVar(&rf.prune, "prune", false, "Remove the folders left empty by the renames.")
+}
+
+// rename processes the plans in their TARGET folder.
+func (rf *renameFlags) rename(plans []hsync.Plan, targets []string) {
+	var journal *hsync.Journal
+	if rf.journal != "" {
+		var err error
+		journal, err = hsync.OpenJournal(rf.journal)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer journal.Close()
+	}
+	for i, target := range targets {
+		if info, err := os.Stat(target); err == nil && !info.IsDir() {
+			log.Fatalf("Cannot rename in '%v': the plan of a manifest must be applied where its folder is", target)
+		}
+		log.Printf(":: Processing renames in '%v'", target)
+		r := hsync.Renamer{Root: target, Clobber: rf.clobber, Journal: journal, Prune: rf.prune}
+		err := r.Rename(plans[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// readPreview returns the plans of the preview file for 'targets', and the
+// targets. A single plan applies to all targets. Without targets, the plans
+// apply to the folders they were analyzed from.
+func readPreview(preview string, targets []string) ([]hsync.Plan, []string) {
+	f, err := os.Open(preview)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plans, err := hsync.ReadPlans(f)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(targets) == 0 {
+		for i, plan := range plans {
+			if plan.Target == "" {
+				log.Fatalf("Plan %v of '%v' has no target", i, preview)
+			}
+			targets = append(targets, plan.Target)
+		}
+	}
+	if len(plans) == 1 {
+		// A single plan applies to all targets.
+		for len(plans) < len(targets) {
+			plans = append(plans, plans[0])
+		}
+	} else if len(plans) != len(targets) {
+		log.Fatalf("Preview has %v plans for %v targets", len(plans), len(targets))
+	}
+	return plans, targets
+}
+
+// createOutput returns the file 'path', created, or standard output if empty.
+func createOutput(path string) *os.File {
+	if path == "" {
+		return os.Stdout
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+// writePreview writes the plans to the file 'preview', or to standard output
+// if empty.
+func writePreview(plans []hsync.Plan, preview string) {
+	w := createOutput(preview)
+	if w != os.Stdout {
+		defer w.Close()
+	}
+	for _, plan := range plans {
+		err := hsync.WritePlan(w, plan)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// validatePlans validates all plans before any rename happens, and exits with
+// a non-zero status if any is invalid.
+func validatePlans(plans []hsync.Plan, targets []string) {
+	valid := true
+	for i, plan := range plans {
+		if !validate(targets[i], plan.ValidateIn(targets[i])) {
+			valid = false
+		}
+	}
+	if !valid {
+		os.Exit(1)
+	}
+}
+
+const analyzeUsage = `Analyze SOURCE and the TARGET folders and write the preview, i.e. the plans of
+the renames to perform in every TARGET, to standard output or to the file given
+with '-o'. Nothing is renamed: use 'apply' for that. See '%v -h' for the
+details of the analysis.`
+
+func analyzeCommand(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v analyze [OPTIONS] SOURCE TARGET...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, analyzeUsage+"\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var af analysisFlags
+	af.register(fs)
+	var flagOutput = fs.String("o", "", "Write the preview to this file instead of standard output.")
+	args = parseArgs(fs, args)
+	if len(args) < 2 {
+		fs.Usage()
+		return
+	}
+
+	source, targets := args[0], args[1:]
+	plans := af.analyze(source, readSource(source), targets)
+	validatePlans(plans, targets)
+	writePreview(plans, *flagOutput)
+}
+
+const applyUsage = `Rename the files of the TARGET folders as planned in PREVIEW, as written by
+'analyze'. A single plan applies to all TARGET folders, otherwise there must be
+one TARGET per plan. Without TARGET, the plans apply to the folders they were
+analyzed from. All plans are validated before any rename happens.`
+
+func applyCommand(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v apply [OPTIONS] PREVIEW [TARGET...]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, applyUsage)
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var rf renameFlags
+	rf.register(fs)
+	args = parseArgs(fs, args)
+	if len(args) < 1 {
+		fs.Usage()
+		return
+	}
+
+	plans, targets := readPreview(args[0], args[1:])
+	validatePlans(plans, targets)
+	rf.rename(plans, targets)
+}
+
+const manifestUsage = `Write the manifest of DIR to standard output, or to the file given with '-o'.
+The manifest lists the files of DIR with their size and their partial hash,
+hashed deep enough to tell the files apart. It can be passed as SOURCE or
+TARGET in place of DIR, e.g. when DIR is on a machine that is not reachable.
+The files of the other side are then hashed to the depths the manifest
+records: the deeper the manifest, the fewer ambiguous matches, at the cost of
+reading more of every file of DIR.`
+
+func manifestCommand(args []string) {
+	fs := flag.NewFlagSet("manifest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v manifest [OPTIONS] DIR\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, manifestUsage)
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var wf walkFlags
+	wf.register(fs)
+	var flagDepth = fs.Int64("depth", 1, "Hash at least this number of blocks of every file.")
+	var flagOutput = fs.String("o", "", "Write the manifest to this file instead of standard output.")
+	args = parseArgs(fs, args)
+	if len(args) != 1 {
+		fs.Usage()
+		return
+	}
+
+	a := wf.analyzer()
+	log.Printf(":: Analyzing '%v'", args[0])
+	m, err := a.Manifest(args[0], *flagDepth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wf.saveCache(a)
+	w := createOutput(*flagOutput)
+	if w != os.Stdout {
+		defer w.Close()
+	}
+	err = hsync.WriteManifest(w, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const checkUsage = `Validate the plans of the preview files without renaming anything. The exit
+status is non-zero if any plan is invalid.`
+
+func checkCommand(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v check PREVIEW...\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, checkUsage)
+	}
+	args = parseArgs(fs, args)
+	if len(args) < 1 {
+		fs.Usage()
+		return
+	}
+	check(args)
+}
+
+const undoUsage = `Restore the layout recorded in the journals written with '-journal' by
+replaying their renames in reverse, pruned folders included. Journals are
+processed in the given order.`
+
+func undoCommand(args []string) {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v undo JOURNAL...\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, undoUsage)
+	}
+	args = parseArgs(fs, args)
+	if len(args) < 1 {
+		fs.Usage()
+		return
+	}
+	for _, journal := range args {
+		log.Printf(":: Undoing '%v'", journal)
+		err := hsync.Undo(journal, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			analyzeCommand(os.Args[2:])
+			return
+		case "apply":
+			applyCommand(os.Args[2:])
+			return
+		case "check":
+			checkCommand(os.Args[2:])
+			return
+		case "manifest":
+			manifestCommand(os.Args[2:])
+			return
+		case "undo":
+			undoCommand(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v [OPTIONS] SOURCE TARGET...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %v analyze [OPTIONS] SOURCE TARGET...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %v apply [OPTIONS] PREVIEW [TARGET...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %v check PREVIEW...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %v manifest [OPTIONS] DIR\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %v undo JOURNAL...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %v -resume JOURNAL [-rollback]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, usage)
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		flag.PrintDefaults()
+	}
+
+	var af analysisFlags
+	af.register(flag.CommandLine)
+	var rf renameFlags
+	rf.register(flag.CommandLine)
+	var flagCheck = flag.Bool("check", false, "Deprecated: use the 'check' command. Only validate the preview files given as arguments.")
+	var flagProcess = flag.Bool("p", false, "Rename the files in TARGETS.")
+	var flagResume = flag.String("resume", "", "Complete the interrupted run recorded in this journal.")
+	var flagRollback = flag.Bool("rollback", false, "With '-resume', revert the interrupted run instead of completing it.")
+	var flagVersion = flag.Bool("v", false, "Print version and exit.")
+	flag.Parse()
+	if *flagVersion {
+		fmt.Println(application, version, copyright)
+		return
+	}
+
+	if *flagResume != "" {
+		resume(*flagResume, *flagRollback, hsync.Renamer{Clobber: rf.clobber, Prune: rf.prune})
+		return
+	}
+
+	if *flagCheck && flag.NArg() > 0 {
+		check(flag.Args())
+		return
+	}
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		return
+	}
+
+	source, targets := flag.Arg(0), flag.Args()[1:]
+
+	s, err := os.Stat(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var plans []hsync.Plan
+	if s.IsDir() {
+		plans = af.analyze(source, sourceList{}, targets)
+	} else if list := readSource(source); list.isSet() {
+		plans = af.analyze(source, list, targets)
+	} else {
+		plans, targets = readPreview(source, targets)
+		for _, plan := range plans {
+			if plan.Hash != "" && flagIsSet(flag.CommandLine, "hash") && plan.Hash != af.hash {
+				log.Fatalf("Preview was generated with hash '%v', not '%v'", plan.Hash, af.hash)
+			}
+		}
+	}
+
+	validatePlans(plans, targets)
+
+	if *flagProcess {
+		rf.rename(plans, targets)
+	} else {
+		log.Println(":: Previewing renames")
+		writePreview(plans, "")
+	}
+}
+
+// validate reports the problems found by the validation of the plan for
+// 'target'. It returns false if there is any.
+func validate(target string, err error) bool {
+	if err == nil {
+		return true
+	}
+	perr, ok := err.(*hsync.PlanError)
+	if !ok {
+		log.Printf("%v: %v", target, err)
+		return false
+	}
+	for _, pb := range perr.Problems {
+		log.Printf("%v: %v", target, pb)
+	}
+	return false
+}
+
+// check validates the plans of the preview files and exits with a non-zero
+// status if any is invalid.
+func check(previews []string) {
+	valid := true
+	for _, preview := range previews {
+		f, err := os.Open(preview)
+		if err != nil {
+			log.Fatal(err)
+		}
+		plans, err := hsync.ReadPlans(f)
+		f.Close()
+		if err != nil {
+			log.Printf("%v: %v", preview, err)
+			valid = false
+			continue
+		}
+		for i, plan := range plans {
+			name := plan.Target
+			if name == "" {
+				name = fmt.Sprintf("%v[%v]", preview, i)
+			}
+			if !validate(name, plan.Validate()) {
+				valid = false
+			}
+		}
+	}
+	if !valid {
+		os.Exit(1)
+	}
+	log.Println(":: Plans are valid")
+}
+
+// resume completes or reverts the last session of 'path' if it was interrupted.
+// Operations are appended to the same journal.
+func resume(path string, rollback bool, r hsync.Renamer) {
+	sessions, err := hsync.ReadSessions(path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(sessions) == 0 || sessions[len(sessions)-1].Done {
+		log.Printf(":: Nothing to resume in '%v'", path)
+		return
+	}
+	s := sessions[len(sessions)-1]
+
+	journal, err := hsync.OpenJournal(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer journal.Close()
+
+	if rollback {
+		log.Printf(":: Rolling back renames in '%v'", s.Root)
+		err = s.Rollback(journal, nil)
+	} else {
+		log.Printf(":: Resuming renames in '%v'", s.Root)
+		r.Journal = journal
+		err = s.Complete(&r)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestSizeFlag(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		want  int64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"123", 123, true},
+		{"10B", 10, true},
+		{"1.5K", 1536, true},
+		{"10m", 10 << 20, true},
+		{"2MB", 2 << 20, true},
+		{"2GiB", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		{"", 0, false},
+		{"inf", 0, false},
+		{"NaN", 0, false},
+		{"1e30", 0, false},
+		{"-1", 0, false},
+		{"1.2.3", 0, false},
+		{"10iB", 0, false},
+		{"10KK", 0, false},
+		{"10Kb", 0, false},
+		{"10P", 0, false},
+		{"8388608T", 0, false},
+		{"99999999999999999999", 0, false},
+	} {
+		var f sizeFlag
+		err := f.Set(tt.input)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v, want success %v", tt.input, err, tt.ok)
+			continue
+		}
+		if tt.ok && int64(f) != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.input, int64(f), tt.want)
+		}
+	}
+}
+
+func TestCheckSizes(t *testing.T) {
+	for _, tt := range []struct {
+		min, max sizeFlag
+		ok       bool
+	}{
+		{0, 0, true},
+		{10, 0, true},
+		{0, 10, true},
+		{10, 10, true},
+		{11, 10, false},
+	} {
+		wf := walkFlags{minSize: tt.min, maxSize: tt.max}
+		if err := wf.checkSizes(); (err == nil) != tt.ok {
+			t.Errorf("Min %v, max %v: got error %v, want success %v", tt.min, tt.max, err, tt.ok)
+		}
+	}
+}
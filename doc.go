@@ -2,32 +2,21 @@
 // Use of this file is governed by the license that can be found in LICENSE.
 
 /*
-A filesystem hierarchy synchronizer
+Package hsync synchronizes filesystem hierarchies.
 
-Rename files in TARGET so that identical files found in SOURCE and TARGET have
-the same relative path.
+It renames files in TARGET so that identical files found in SOURCE and TARGET
+have the same relative path. An Analyzer matches the files of both folders and
+produces a Plan; a Renamer processes the renames of a Plan.
 
-The main goal of the program is to make folders synchronization faster by
-sparing big file transfers when a simple rename suffices. It complements other
-synchronization programs that lack this capability.
-
-See http://ambrevar.bitbucket.io/hsync and 'hsync -h' for more details.
-
-Usage:
-
-	hsync [OPTIONS] SOURCE TARGET
-
-For usage options, see:
-
-	hsync -h
+The command-line interface is github.com/ambrevar/hsync/cmd/hsync.
 
 Implementation details
 
 We store the file entries in the following structure:
 
 	entries := map[partialHash struct{size int64, pos int64, hash string}]fileMatch struct{
-		sourceID *fileID{path string, h hash.Hash},
-		targetID *fileID{path string, h hash.Hash}
+		sourceID *fileID{dir *dirNode, name string, state []byte},
+		targetID *fileID{dir *dirNode, name string, state []byte}
 	}
 
 This 'entries' map indexes the possible file matches by content ('partialHash').
@@ -51,9 +40,10 @@ believed to be optimal in most cases. The optimal value would be the device
 blocksize where the file resides. It would be more complex and memory consuming
 to query this value for each file.
 
-We choose md5 (128 bits) as the checksum algorithm. Adler32, CRC-32 and CRC-64
-are only a tiny little faster while suffering from more clashes. This choice
-should be backed up with a proper benchmark.
+The checksum algorithm is pluggable, see Hashes and RegisterHash. The default
+is md5 (128 bits). Non-cryptographic algorithms like CRC-64 and xxHash are
+faster while suffering from more clashes; cryptographic ones like SHA-256 and
+BLAKE2b are slower but make false positives on partial hashes less likely.
 
 A conflict arises when two files in either SOURCE or TARGET have the same
 partial hash. We solve the conflict by updating the partial hashes until they
@@ -71,6 +61,11 @@ they have the same size.
 
 - There is only one possible conflicting file at a time.
 
+- Files of different sizes never conflict. When the analysis is parallel, the
+files are grouped by size and each group is processed sequentially, in the
+order of the walk, by one of the workers. The result is thus the same as with a
+sequential analysis. Only the 'entries' map needs a mutex.
+
 A file match may be erroneous if the partial hash is not complete. The most
 obvious case is when two different files are the only ones of size N in SOURCE
 and TARGET. This down-side is a consequence of the design choice, i.e. focus on
@@ -78,17 +73,42 @@ speed. Erroneous matches can be corrected in the preview file. If we wanted no
 ambiguity, we would have to compute the full hashes and this would take
 approximately as much time as copying files from SOURCE to TARGET, like a
 regular synchronization tool would do.
-
-We store the digest 'hash.Hash' together with the file path for when we update a
-partial hash.
+This is what the optional verification does: once TARGET is analyzed, the
+content of every match leading to a rename is compared byte by byte and the
+false positives are rejected.
+
+We store the state of the digest together with the file path for when we update
+a partial hash. Most files are never rolled, so the state is only stored once a
+file takes part in a conflict, marshaled with encoding.BinaryMarshaler: files
+that are never rolled hold no digest at all. Paths are split into an interned
+folder and a name, folders being stored as a tree of their parents, so that the
+files of a folder share its path. BenchmarkSourceMemory compares the memory held
+per file with the former full path and live digest, with and without rolls.
+
+Partial hashes can be stored across runs in a Cache. For every file, the cache
+holds the digest of every roll computed so far and the marshaled digest state
+of the last roll. A roll is served from the cache when possible, in which case
+the digest state of the fileID falls behind; it is restored from the cached
+state, or computed again from the file, before the next block is read. Entries
+are invalidated when the size, the modification time or the inode of the file
+change.
 
 Process:
 
-1. We walk SOURCE completely. Only regular files are processed. The 'sourceID'
+1. We walk SOURCE completely. Only regular files are processed. Files and
+folders can be filtered with .gitignore-like patterns; since the patterns of a
+folder only apply to its content, they are passed down the walk, and excluded
+folders are pruned. Symbolic links to folders are optionally followed. To
+detect loops, every folder being walked carries the chain of its ancestors,
+identified by device and inode numbers: a link to one of them is skipped. Other
+links to an already walked folder are followed, their files become duplicates.
+Folders on another device than the walked folder, e.g. mount points, can be
+skipped as well, since files cannot be renamed across devices. The 'sourceID'
 are stored. If two entries conflict (they have the same partial hash), we
 compute update the partial hashes until they do not conflict anymore. If the
 conflict is not resolvable, i.e. the partial hash is complete and files are
-identical, we drop both files from 'entries'.
+identical, we store the new file as a duplicate of the existing entry
+('sourceDups').
 
 Future files can have the same partial hash that led to a former conflict. To
 distinguish the content from former conflicts when adding a new file, we must
@@ -98,19 +118,25 @@ all computed partial hash as dummy values. When the next entry will be added, we
 will have to compute the partial hash until it does not match a dummy value in
 'entries'.
 
-Duplicates are not processed but display a warning. Usually the user does not
-want duplicates, so she is better off fixing them before processing with the
-renames. It would add a lot of complexity to handle duplicates properly.
+Duplicates display a warning. Usually the user does not want duplicates, so by
+default they are not processed: the user is better off fixing them before
+processing with the renames. See step 3 for the processing of duplicates.
 
 2. We walk TARGET completely. We skip all dummies as source the SOURCE walk.
 We need to analyze SOURCE completely before we can check for matches.
 
-- If there are only dummy entries, there was an unsolvable conflict in SOURCE.
-We drop the file.
+The SOURCE walk stores the identity of its folders. TARGET folders that are
+SOURCE folders at the same path, e.g. through a bind mount, are not walked:
+hashing their files would be a waste since they are the SOURCE files, in place.
+Before the pairing, these SOURCE files are removed from the entries so that no
+other TARGET file gets renamed onto them.
+
+Each TARGET is matched against its own copy of the SOURCE entries: conflicts
+update the partial hashes of SOURCE files and mark entries as dummies or
+duplicates, which must not leak into the analysis of another TARGET. The
+fileIDs are duplicated, but not their digest state: a roll replaces it.
 
-- If we end on a non-empty entry with an 'unsolvable' targetID, it means that an
-unsolvable conflict with target files happened with this partial hash. This is
-only possible at end-of-file. We drop the file.
+- If there are only dummy entries, we drop the file.
 
 - If we end on an empty entry, there is no match with SOURCE and we drop the
 file.
@@ -121,15 +147,57 @@ match.
 - Else we end on a non-empty entry with one match already present. This is a
 conflict. We solve the conflict as for the SOURCE walk except that we need to
 update the partial hashes of three files: the SOURCE file, the first TARGET
-match and the new TARGET match.
-
-3. We generate the 'renameOps' and 'reverseOps' maps. They map 'oldpath' to
+match and the new TARGET match. If all three files are identical, the new TARGET
+match is stored as a duplicate ('targetDups'). When the partial hash of the
+entry is already complete, no update is needed and the new TARGET file is a
+duplicate straight away.
+
+3. We pair the matching files. Entries with duplicates are skipped, unless
+duplicates processing is enabled. In that case, the N SOURCE duplicates and the
+M TARGET duplicates of an entry are paired so as to minimize the number of
+renames: the TARGET files already at the path of a SOURCE duplicate stay in
+place, the others are paired in lexical order. The min(N, M) first pairs are
+kept, the remaining files are reported.
+
+We generate the 'renameOps' and 'reverseOps' maps. They map 'oldpath' to
 'newpath' and 'newpath' to 'oldpath' respectively. We drop entries where
 'oldpath==newpath' to spare a lot of noise.
 
+Optionally, the renames of all the files of a TARGET folder are collapsed into
+the rename of the folder when they all move to the same new folder with the same
+layout. This only holds if the folder contains nothing else but renamed files,
+since the other files would move along, and if the new folder does not exist
+yet. Folder renames are processed before file renames since files can be renamed
+into the old path of a folder.
+
+Symbolic links are optionally matched too. They have no content of their own,
+so they are matched by the text of their target. When relocating, relative
+targets are resolved against the folder of the link instead, and the resolved
+path of a TARGET link goes through the renames of the files: a link still
+matches if the file it points to moves with it. The link is then rewritten with
+the target of its SOURCE counterpart, which is done by renaming a new link over
+it. Links with duplicates are skipped.
+
 Note that file names are not used to compute a match since they could be
 identical while the content would be different.
 
+Either side can be a Manifest instead of a folder: the list of its files with
+their partial hash, as resolved by a SOURCE walk, and optionally rolled further
+to a minimum depth. Complete partial hashes are normalized to the number of
+blocks of the file, since the rolls past the end do not change the hash. The
+files of a manifest cannot be read, so conflicts are resolved on the local side
+only: every local file is hashed to each depth the manifest records for its
+size, and stored under each of these partial hashes. A local file matches if it
+is the only one under the partial hash of a manifest file. Several local files
+under an incomplete partial hash cannot be told apart and are skipped, while
+complete ones are duplicates and paired as above.
+
+SOURCE can also be a checksum list, as written by md5sum and the like: the
+digests of the whole content of the files, but not their size. The list
+replaces the SOURCE walk and is indexed by digest. Every TARGET file is then
+rolled to the end, and its complete partial hash, which is the digest of the
+whole file, is looked up in the list. Matches are paired as for a manifest.
+
 4. We proceed with the renames. Chains and cycles may occur.
 
 - Example of a chain of renames: a->b, b->c, c->d.
@@ -146,5 +214,29 @@ going backward till the beginning. The beginning can be before the entry point.
 When a cycle is detected, we break it down to a chain. We rename one file to a
 temporary name. Then we add this new file to the other end of the chain so that
 it gets renamed to its original new name once all files have been processed.
+
+Unless clobbering is allowed, renames must not overwrite existing files. A
+check before the rename would race with other programs creating the
+destination. On Linux we use renameat2(2) with RENAME_NOREPLACE, which fails
+atomically if the destination exists. Where it is not supported, we create a
+hard link to the destination, which fails likewise, then remove the original
+link; this is not atomic but never overwrites. Last, on filesystems without
+hard links, we fall back to the racy check.
+
+5. Every processed rename, including the renames to and from temporary names,
+can be appended to a Journal, together with the folders created on the way and
+the folders pruned once emptied by the renames. Each line is synced to disk
+before the next operation. Undoing consists in replaying the journal in reverse:
+renames are reverted, created folders are removed if empty and pruned folders
+are created again.
+
+The journal starts every session with the plan, and ends it with a completion
+mark. The name of a temporary file is recorded before the file is created. A
+session without completion mark was interrupted: the remaining renames are the
+plan minus the recorded renames, where a file moved to a temporary name is
+pending under that name. Resuming processes the remaining renames as a new
+session, while rolling back reverts the recorded operations. Temporary files
+that are still empty are removed. A temporary file that holds a file whose
+rename was not recorded is plugged back into its cycle.
 */
-package main
+package hsync
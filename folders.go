@@ -0,0 +1,158 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// parents returns the folders containing 'path', from the deepest to the
+// topmost, excluding the root.
+func parents(path string) []string {
+	var dirs []string
+	for dir := filepath.Dir(path); dir != "." && dir != separator; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// inFolder reports whether 'path' is 'dir' or inside it.
+func inFolder(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+separator)
+}
+
+// collapseFolders replaces the renames of all the files of a TARGET folder by
+// the rename of the folder itself when they all move to the same new folder
+// with the same layout. The topmost such folders are collapsed. A folder is
+// only collapsed if
+// - every entry it contains, other than folders, is renamed: folder renames
+// also move the files that are not matched;
+// - it contains no symbolic link to rewrite;
+// - its new path does not exist in 'root';
+// - no other file is renamed into its new path;
+// - its new path is not inside another collapsed folder.
+// Empty subfolders move along with the folder. The matches of the files are
+// kept so that they can be checked before the folder is renamed.
+func (a *Analyzer) collapseFolders(p *Plan, root string) {
+	// For every TARGET folder, the new folder its files move to, and the number
+	// of such files. An empty new folder means that the files do not agree.
+	dests := make(map[string]string)
+	files := make(map[string]int)
+	// Number of files renamed into every path.
+	incoming := make(map[string]int)
+	for oldpath, newpath := range p.Renames {
+		// Links to rewrite cannot move along with their folder.
+		_, relink := p.Links[oldpath]
+		for _, dir := range parents(oldpath) {
+			rel := oldpath[len(dir):]
+			dest := ""
+			if !relink && strings.HasSuffix(newpath, rel) {
+				dest = newpath[:len(newpath)-len(rel)]
+			}
+			if prev, ok := dests[dir]; ok && prev != dest {
+				dest = ""
+			}
+			dests[dir] = dest
+			files[dir]++
+		}
+		incoming[newpath]++
+		for _, dir := range parents(newpath) {
+			incoming[dir]++
+		}
+	}
+
+	dirs := make([]string, 0, len(dests))
+	for dir, dest := range dests {
+		if dest != "" && dest != dir {
+			dirs = append(dirs, dir)
+		}
+	}
+	// Folders sort before their subfolders.
+	sort.Strings(dirs)
+
+	var collapsed []string
+	for _, dir := range dirs {
+		dest := dests[dir]
+		if inCollapsed(dir, collapsed) {
+			continue
+		}
+		if inFolder(dest, dir) || incoming[dest] != files[dir] {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(root, dest)); !os.IsNotExist(err) {
+			continue
+		}
+		if countFiles(filepath.Join(root, dir)) != files[dir] {
+			continue
+		}
+		collapsed = append(collapsed, dir)
+	}
+
+	// A folder cannot be moved into another collapsed folder: the order of the
+	// renames would matter.
+	var kept []string
+	for _, dir := range collapsed {
+		inside := false
+		for _, other := range collapsed {
+			if inFolder(dests[dir], other) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			kept = append(kept, dir)
+		}
+	}
+	collapsed = kept
+
+	if len(collapsed) == 0 {
+		return
+	}
+	if p.Folders == nil {
+		p.Folders = make(map[string]bool)
+	}
+	for oldpath := range p.Renames {
+		if inCollapsed(oldpath, collapsed) {
+			delete(p.Renames, oldpath)
+		}
+	}
+	for _, dir := range collapsed {
+		p.Renames[dir] = dests[dir]
+		p.Folders[dir] = true
+	}
+}
+
+// inCollapsed reports whether 'path' is inside one of the folders of the
+// sorted slice 'collapsed'.
+func inCollapsed(path string, collapsed []string) bool {
+	for _, dir := range parents(path) {
+		i := sort.SearchStrings(collapsed, dir)
+		if i < len(collapsed) && collapsed[i] == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// countFiles returns the number of entries in 'dir' that are not folders, or
+// -1 on error.
+func countFiles(dir string) int {
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return -1
+	}
+	return count
+}
@@ -0,0 +1,121 @@
+package hsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFolders(t *testing.T) {
+	source := writeTree(t, map[string]string{
+		"archive/photos/2015/a":     "a",
+		"archive/photos/2015/b":     "bb",
+		"archive/photos/2015/sub/c": "ccc",
+		"archive/photos/2016/d":     "dddd",
+		"docs/e":                    "eeeee",
+	})
+	defer os.RemoveAll(source)
+	target := writeTree(t, map[string]string{
+		"photos/2015/a":     "a",
+		"photos/2015/b":     "bb",
+		"photos/2015/sub/c": "ccc",
+		"photos/2016/d":     "dddd",
+		"photos/2016/new":   "unmatched",
+		"old/e":             "eeeee",
+	})
+	defer os.RemoveAll(target)
+
+	discard := log.New(ioutil.Discard, "", 0)
+	a := NewAnalyzer()
+	a.Log = discard
+	a.Folders = true
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Analyze(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 'photos/2016' holds an unmatched file, so 'photos' cannot be collapsed.
+	wantRenames := map[string]string{
+		"photos/2015":   "archive/photos/2015",
+		"photos/2016/d": "archive/photos/2016/d",
+		"old":           "docs",
+	}
+	if !reflect.DeepEqual(p.Renames, wantRenames) {
+		t.Errorf("Got renames %v, want %v", p.Renames, wantRenames)
+	}
+	if want := map[string]bool{"photos/2015": true, "old": true}; !reflect.DeepEqual(p.Folders, want) {
+		t.Errorf("Got folders %v, want %v", p.Folders, want)
+	}
+
+	r := Renamer{Root: target, Log: discard}
+	if err := r.Rename(p); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := readTree(t, target)
+	wantFiles := map[string]string{
+		"archive/photos/2015/a":     "a",
+		"archive/photos/2015/b":     "bb",
+		"archive/photos/2015/sub/c": "ccc",
+		"archive/photos/2016/d":     "dddd",
+		"photos/2016/new":           "unmatched",
+		"docs/e":                    "eeeee",
+	}
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("Got files %v, want %v", files, wantFiles)
+	}
+}
+
+func TestFolderChanged(t *testing.T) {
+	source := writeTree(t, map[string]string{"new/a": "a", "new/b": "bb"})
+	defer os.RemoveAll(source)
+	target := writeTree(t, map[string]string{"old/a": "a", "old/b": "bb"})
+	defer os.RemoveAll(target)
+
+	discard := log.New(ioutil.Discard, "", 0)
+	a := NewAnalyzer()
+	a.Log = discard
+	a.Folders = true
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Analyze(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"old": "new"}; !reflect.DeepEqual(p.Renames, want) {
+		t.Fatalf("Got renames %v, want %v", p.Renames, want)
+	}
+
+	// The matches of the files survive the preview.
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Matches, p.Matches) || len(got.Matches) != 2 {
+		t.Errorf("Got matches %v, want %v", got.Matches, p.Matches)
+	}
+
+	// Same size, different content.
+	if err := ioutil.WriteFile(filepath.Join(target, "old/b"), []byte("BB"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r := Renamer{Root: target, Log: discard}
+	if err := r.Rename(got); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := readTree(t, target)
+	if want := map[string]string{"old/a": "a", "old/b": "BB"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("Got files %v, want %v", files, want)
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/ambrevar/hsync
+
+go 1.21
+
+require (
+	golang.org/x/crypto v0.9.0
+	golang.org/x/sys v0.9.0
+)
@@ -2,96 +2,82 @@
 // Use of this file is governed by the license that can be found in LICENSE.
 
 /*
-TODO: Add support for multiple targets.
-TARGETS can be analyzed in parallel but beware of race conditions when a
-conflict arises. Example: t1 in TARGET matches s1 in SOURCE and is stored in the
-structure. t2 in TARGET matches s1 too. There is a conflict. We need to update
-s1, t1 and t2 at the same time until t1 != t2 or end of file is reached.
-
-TODO: If duplicate count is the same on both sides, we could still process.
-We should minimize the number of renames.
-
-TODO: Multi-threading: The main structure should be mutexed, but the checksums can be parallelized.
-
-TODO: Save on resident memory usage.
-Currently 200000 files in /usr will require ~100 MB.
-Shall we use a trie to store paths? Not sure it would save memory.
-
-TODO: Possible optimization: we can skip target (sub)folders where
-os.SameFile(sourceFolder, targetFolder) == true. Then we need to store source's
-FileInfo in a map.
-
-TODO: This program could be split in two: the analyzer and the renamer.
-
 References: dupd, dupfinder, fdupes, gotsync, rmlint, rsync.
 */
 
-package main
+package hsync
 
 import (
-	"crypto/md5"
-	"encoding/json"
-	"flag"
+	"encoding"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 )
 
 const (
 	application = "hsync"
-	copyright   = "Copyright (C) 2015-2016 Pierre Neidhardt"
 	blocksize   = 4096
 	separator   = string(os.PathSeparator)
 )
 
-var version = "<tip>"
-
-const usage = `Filesystem hierarchy synchronizer
-
-Rename files in TARGET so that identical files found in SOURCE and TARGET have
-the same relative path.
-
-The main goal of the program is to make folders synchronization faster by
-sparing big file transfers when a simple rename suffices. It complements other
-synchronization programs that lack this capability.
-
-By default, files are not renamed and a preview is printed to standard output.
-
-False positives can happen, e.g. if two different files in SOURCE and TARGET are
-the only ones of this size. Use the preview to spot false positives and make sure
-all files get renamed properly.
-
-You can redirect the preview to a file. If you run the program using this
-preview file as SOURCE, the analysis will be skipped. This is useful if you want
-to tweak the result of the analysis.
-
-Notes:
-- Duplicate files in either folder are skipped.
-- Only regular files are processed. In particular, empty folders and symbolic
-links are ignored.
-`
+var (
+	errNoSource     = errors.New("SOURCE has not been visited")
+	errNotDir       = errors.New("not a directory")
+	errTempFile     = errors.New("cannot create temporary file")
+	errNotSupported = errors.New("not supported")
+)
 
-// We attach a hash digest to the path so that we can update partial hashes with
-// the rolling-checksum function.
+// We attach the state of the hash digest to the path so that we can update
+// partial hashes with the rolling-checksum function. To save memory on huge
+// trees, the folder of the path is interned, see pathTable, and the state is
+// only stored once the partial hash has been rolled, i.e. when the file took
+// part in a conflict. It is marshaled with encoding.BinaryMarshaler; if the
+// digest does not support it, 'state' is nil and the digest is computed again
+// from the file for every roll.
+// When a cache is used, 'stale' is true if the last rolls were served from the
+// cache, in which case 'state' is behind the partial hash.
 type fileID struct {
-	path string
-	h    hash.Hash
+	dir   *dirNode
+	name  string
+	state []byte
+	cache *cacheEntry
+	stale bool
 }
 
-var unsolvable = fileID{path: separator}
+// path returns the path of the file relative to its root.
+func (fid *fileID) path() string {
+	if fid.dir == nil {
+		return fid.name
+	}
+	return fid.dir.path() + separator + fid.name
+}
 
 // A fileMatch stores 2 fileID with matching content. A match can be partial and
 // further processing can disprove it.
 // - If 'sourceID==nil', this is a dummy match. It means that a file of the same
 // size with a longer partialHash has been processed.
 // - If 'targetID==nil', a match is yet to be found.
-// - If 'targetID==&unsolvable', several TARGET files conflict together for this
-// SOURCE file, the entry should be skipped.
+// - 'sourceDups' and 'targetDups' hold the duplicates of 'sourceID' and
+// 'targetID' respectively. Duplicates are only possible when the partialHash
+// is complete.
 type fileMatch struct {
+	sourceID   *fileID
+	targetID   *fileID
+	sourceDups []*fileID
+	targetDups []*fileID
+}
+
+// A match is a pair of files with identical content, 'key' being the partial
+// hash of both files.
+type match struct {
+	key      partialHash
 	sourceID *fileID
 	targetID *fileID
 }
@@ -105,12 +91,302 @@ type partialHash struct {
 	hash string
 }
 
+// An Analyzer matches the files of a TARGET folder against the files of a
+// SOURCE folder. The result is a Plan of the renames that give identical files
+// the same relative path in both folders.
+//
+// VisitSource must be called before Analyze. Analyze can then be called for
+// several TARGET folders, concurrently or not: each call works on its own copy
+// of the SOURCE entries, so that the conflicts of one TARGET do not affect the
+// others.
+type Analyzer struct {
+	// Log receives the warnings emitted during the analysis, e.g. duplicates
+	// and read errors. The standard logger is used if nil.
+	Log *log.Logger
+
+	// Hash is the name of the checksum algorithm used for partial hashes. See
+	// Hashes for the available algorithms.
+	Hash string
+
+	// Jobs is the number of files processed concurrently. The analysis is
+	// sequential if Jobs <= 1.
+	Jobs int
+
+	// Verify makes the analysis compare the whole content of the matches to
+	// discard false positives. This is approximately as costly as reading all
+	// matching files.
+	Verify bool
+
+	// Duplicates makes the analysis pair files having duplicates in SOURCE or
+	// TARGET. By default such files are skipped.
+	Duplicates bool
+
+	// Cache, if not nil, stores the partial hashes across runs. It must use
+	// the same checksum algorithm as the Analyzer.
+	Cache *Cache
+
+	// Include, if not empty, restricts the analysis to the files matching at
+	// least one of its patterns, or in a folder that does. Exclude skips the
+	// files and folders matching its patterns. Patterns follow the .gitignore
+	// syntax and are relative to the walked folder. Every folder may also
+	// contain a '.hsyncignore' file that applies to its content; Exclude takes
+	// precedence over it.
+	Include []string
+	Exclude []string
+
+	// MinSize and MaxSize, if not zero, skip the files smaller or bigger than
+	// them respectively, in bytes. Small files are cheap to transfer and make
+	// most of the duplicates.
+	MinSize int64
+	MaxSize int64
+
+	// Folders makes the analysis rename whole folders when all their files
+	// move to the same new folder with the same layout. See collapseFolders.
+	Folders bool
+
+	// Symlinks makes the analysis match symbolic links by their target, as a
+	// string. They are ignored otherwise.
+	Symlinks bool
+
+	// RelocateLinks makes the analysis match the symbolic links with a
+	// relative target by the path they resolve to, so that a link can be
+	// renamed to a folder of a different depth. The target of such links is
+	// rewritten after the rename. It implies Symlinks.
+	RelocateLinks bool
+
+	// Follow makes the walks descend into the symbolic links to folders. The
+	// files found there keep the path they have through the link, so that
+	// they are renamed relative to TARGET. Links leading back to a folder
+	// being walked are skipped, and so are the links of TARGET leading out of
+	// it.
+	Follow bool
+
+	// OneFileSystem makes the walks skip the folders on another device than
+	// the walked folder, such as mount points: renames across devices fail
+	// anyway. It has no effect where devices are not supported.
+	OneFileSystem bool
+
+	sourceRoot string
+	newHash    func() hash.Hash
+	entries    *entryMap
+	links      *linkMap
+	// The folders of SOURCE, see visitSourceDir.
+	sourceDirs *dirMap
+	// The manifest SOURCE, see VisitManifest.
+	manifest *manifestIndex
+	// The checksum list SOURCE by digest, see VisitChecksums.
+	sums map[string][]*fileID
+}
+
+// NewAnalyzer returns an Analyzer with no SOURCE that uses DefaultHash.
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{Hash: DefaultHash, entries: newEntryMap(), links: &linkMap{}, sourceDirs: newDirMap()}
+}
+
+// A Plan lists the renames to perform in TARGET. See WritePlan for its JSON
+// representation.
+type Plan struct {
+	// Target is the TARGET folder as passed to Analyze.
+	Target string
+
+	// Hash is the name of the checksum algorithm used during the analysis.
+	Hash string
+
+	// Renames maps old paths to new paths. Paths are relative to TARGET.
+	Renames map[string]string
+
+	// Matches holds the details of the match of the renames, by old path, and
+	// of the files of the renamed folders. It may be incomplete, e.g. if the
+	// plan was edited or written in a legacy format.
+	Matches map[string]Match
+
+	// Folders lists the old paths of Renames that are folders. A folder rename
+	// replaces the renames of all the files it contains.
+	Folders map[string]bool
+
+	// Verified is true if the content of all renamed files has been compared
+	// to their match in SOURCE.
+	Verified bool
+
+	// Rejected lists the matches discarded by the verification, with the same
+	// layout as Renames.
+	Rejected map[string]string
+
+	// MinSize and MaxSize are the size thresholds of the analysis, if any.
+	MinSize int64
+	MaxSize int64
+
+	// Links maps the old paths of the symbolic links of Renames whose target
+	// must be rewritten to their new target.
+	Links map[string]string
+}
+
+// A Match describes how a TARGET file was matched to a SOURCE file.
+type Match struct {
+	// Size is the size of the files.
+	Size int64 `json:"size"`
+
+	// Pos is the number of blocks hashed before the match was found. It is 0
+	// if only the sizes were compared.
+	Pos int64 `json:"pos"`
+
+	// Hash is the partial hash of the files, in hexadecimal.
+	Hash string `json:"hash,omitempty"`
+
+	// Verified is true if the content of the files has been compared.
+	Verified bool `json:"verified,omitempty"`
+
+	// Fingerprint is the digest of the first block of the TARGET file, in
+	// hexadecimal. Together with Size, it is checked before renaming to skip
+	// the files that changed since the analysis. The files that pass are then
+	// checked against Pos and Hash.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Real is the real path of the TARGET file when it was found through a
+	// symbolic link to a folder, see Follow. The rename still goes through
+	// the link.
+	Real string `json:"real,omitempty"`
+}
+
+// Confidence returns how reliable the match is, from the most to the least
+// reliable: "verified" if the content of the files has been compared, "full"
+// if the files have been hashed completely, "partial" if only their beginning
+// has, and "size" if only their sizes have been compared.
+func (m Match) Confidence() string {
+	switch {
+	case m.Verified:
+		return "verified"
+	case m.Pos*blocksize >= m.Size:
+		return "full"
+	case m.Pos > 0:
+		return "partial"
+	}
+	return "size"
+}
+
+// entryMap is the 'entries' structure. Files of different sizes never
+// conflict, so the entries of different sizes can be processed concurrently:
+// only the map itself needs to be guarded.
+type entryMap struct {
+	mu sync.Mutex
+	m  map[partialHash]fileMatch
+	// The folders of the files added to the map.
+	paths *pathTable
+	// The SOURCE folders that are TARGET folders too, see visitTarget.
+	shared map[string]bool
+}
+
+func newEntryMap() *entryMap {
+	return &entryMap{m: make(map[partialHash]fileMatch), paths: newPathTable()}
+}
+
+func (e *entryMap) get(key partialHash) (fileMatch, bool) {
+	e.mu.Lock()
+	v, ok := e.m[key]
+	e.mu.Unlock()
+	return v, ok
+}
+
+func (e *entryMap) set(key partialHash, v fileMatch) {
+	e.mu.Lock()
+	e.m[key] = v
+	e.mu.Unlock()
+}
+
+func (e *entryMap) share(dir string) {
+	e.mu.Lock()
+	if e.shared == nil {
+		e.shared = make(map[string]bool)
+	}
+	e.shared[dir] = true
+	e.mu.Unlock()
+}
+
+// isShared reports whether the SOURCE file 'path' is in a shared folder.
+func (e *entryMap) isShared(path string) bool {
+	if e.shared["."] {
+		return true
+	}
+	for _, dir := range parents(path) {
+		if e.shared[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneSource returns a copy of the SOURCE entries. The fileIDs are
+// duplicated since they get updated when a TARGET conflict arises. The TARGET
+// files get a new pathTable.
+func (a *Analyzer) cloneSource() *entryMap {
+	a.entries.mu.Lock()
+	defer a.entries.mu.Unlock()
+	c := &entryMap{m: make(map[partialHash]fileMatch, len(a.entries.m)), paths: newPathTable()}
+	for k, v := range a.entries.m {
+		if v.sourceID != nil {
+			dups := make([]*fileID, len(v.sourceDups))
+			for i, fid := range v.sourceDups {
+				dups[i] = cloneID(fid)
+			}
+			v = fileMatch{sourceID: cloneID(v.sourceID), sourceDups: dups}
+		}
+		c.m[k] = v
+	}
+	return c
+}
+
+// cloneID duplicates 'fid'. The digest state can be shared: rolls replace it
+// and never modify it.
+func cloneID(fid *fileID) *fileID {
+	c := *fid
+	return &c
+}
+
+func logf(l *log.Logger, format string, v ...interface{}) {
+	if l == nil {
+		log.Printf(format, v...)
+		return
+	}
+	l.Printf(format, v...)
+}
+
 // rollingChecksum returns io.EOF on last roll.
 // The caller needs not open `file`; it needs to close it however. This manual
 // management avoids having to open and close the file repeatedly.
-func rollingChecksum(fid *fileID, key *partialHash, file **os.File) (err error) {
+// If the file has a cache entry, the partial hash is read from the cache when
+// possible.
+func (a *Analyzer) rollingChecksum(root string, fid *fileID, key *partialHash, file **os.File) (err error) {
+	if fid.cache != nil {
+		if sum, ok := fid.cache.sum(key.pos); ok {
+			fid.stale = true
+			key.pos++
+			key.hash = string(sum)
+			// Same as ReadAt: EOF is reached if the block is not full.
+			if key.pos*blocksize > key.size {
+				return io.EOF
+			}
+			return nil
+		}
+	}
+
 	if *file == nil {
-		*file, err = os.Open(fid.path)
+		*file, err = os.Open(filepath.Join(root, fid.path()))
+		if err != nil {
+			return
+		}
+	}
+
+	h := a.newHash()
+	if fid.stale {
+		if !fid.cache.restore(h, key.pos) {
+			err = rehash(h, *file, key.pos)
+			if err != nil {
+				return
+			}
+		}
+		fid.stale = false
+	} else if key.pos > 0 && !unmarshalState(h, fid.state) {
+		err = rehash(h, *file, key.pos)
 		if err != nil {
 			return
 		}
@@ -122,442 +398,520 @@ func rollingChecksum(fid *fileID, key *partialHash, file **os.File) (err error)
 		return
 	}
 	// Failure means fatal memory error, no need to handle it.
-	_, _ = fid.h.Write(buf[:n])
+	_, _ = h.Write(buf[:n])
+	sum := h.Sum(nil)
+	fid.state = marshalState(h)
+	if fid.cache != nil {
+		fid.cache.record(key.pos, sum, fid.state)
+	}
 	key.pos++
-	key.hash = string(fid.h.Sum(nil))
+	key.hash = string(sum)
 	return
 }
 
-func newFileEntry(path string, size int64) (fileID, partialHash) {
-	return fileID{path: path, h: md5.New()}, partialHash{size: size}
+// marshalState returns the state of 'h', or nil if it cannot be marshaled.
+func marshalState(h hash.Hash) []byte {
+	m, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
+// unmarshalState sets the state of 'h' to 'state'. It reports whether it
+// succeeded.
+func unmarshalState(h hash.Hash, state []byte) bool {
+	u, ok := h.(encoding.BinaryUnmarshaler)
+	return ok && state != nil && u.UnmarshalBinary(state) == nil
 }
 
-func visitSource(root string, entries map[partialHash]fileMatch) {
-	// Change folder to 'root' so that 'root' does not get stored in fileID.path.
-	oldroot, err := os.Getwd()
+// rehash resets 'h' to the digest of the first 'pos' blocks of 'file'.
+func rehash(h hash.Hash, file *os.File, pos int64) error {
+	h.Reset()
+	_, err := io.Copy(h, io.NewSectionReader(file, 0, pos*blocksize))
+	return err
+}
+
+// newFileEntry returns the fileID of 'path' in 'root', interned in 'paths', and
+// its initial partial hash.
+func (a *Analyzer) newFileEntry(paths *pathTable, root, path string, info os.FileInfo) (fileID, partialHash) {
+	fid := paths.id(path)
+	if a.Cache != nil {
+		fid.cache = a.Cache.entry(filepath.Join(root, path), info)
+	}
+	return fid, partialHash{size: info.Size()}
+}
+
+// VisitSource walks SOURCE completely and stores its files.
+func (a *Analyzer) VisitSource(root string) error {
+	if a.Hash == "" {
+		a.Hash = DefaultHash
+	}
+	newHash, err := lookupHash(a.Hash)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if a.Cache != nil && a.Cache.hash != a.Hash {
+		return fmt.Errorf("cache uses hash '%v', not '%v'", a.Cache.hash, a.Hash)
 	}
-	err = os.Chdir(root)
+	root, err = resolveRoot(root)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	// Chdir to oldroot can fail: if so, the error will be caught in the subsequent Chdir.
-	defer os.Chdir(oldroot)
+	a.newHash = newHash
+	a.sourceRoot = root
+	return a.walk(root, a.visitSourceDir, a.visitSource)
+}
 
-	visitor := func(input string, info os.FileInfo, ignored error) error {
-		if !info.Mode().IsRegular() {
-			return nil
+// visitSourceDir stores the identity of the SOURCE folder 'input' so that
+// TARGET folders can be compared to it.
+func (a *Analyzer) visitSourceDir(input string, info os.FileInfo) bool {
+	id, err := identify(filepath.Join(a.sourceRoot, input), info)
+	if err != nil {
+		logf(a.Log, "%v", err)
+		return true
+	}
+	a.sourceDirs.add(id, input)
+	return true
+}
+
+func (a *Analyzer) visitSource(input string, info os.FileInfo) {
+	root := a.sourceRoot
+	if isSymlink(info) {
+		a.visitLink(a.links, root, input)
+		return
+	}
+	inputID, inputKey := a.newFileEntry(a.entries.paths, root, input, info)
+	var err error
+
+	var inputFile, conflictFile *os.File
+	defer func() {
+		if inputFile != nil {
+			inputFile.Close()
+		}
+	}()
+	defer func() {
+		if conflictFile != nil {
+			conflictFile.Close()
 		}
+	}()
 
-		// Ignore empty files as they add a lot of unnecessary noise to the
-		// duplicate detection and output.
-		if info.Size() == 0 {
-			return nil
+	// Skip dummy matches.
+	v, ok := a.entries.get(inputKey)
+	for ok && v.sourceID == nil && err != io.EOF {
+		err = a.rollingChecksum(root, &inputID, &inputKey, &inputFile)
+
+		if err != nil && err != io.EOF {
+			logf(a.Log, "%v", err)
+			return
 		}
+		v, ok = a.entries.get(inputKey)
+	}
 
-		inputID, inputKey := newFileEntry(input, info.Size())
-		var err error
+	if ok && v.sourceID == nil {
+		logf(a.Log, "Source duplicate (%x) '%v'\n", inputKey.hash, inputID.path())
+		return
+	} else if !ok {
+		a.entries.set(inputKey, fileMatch{sourceID: &inputID})
+		return
+	}
 
-		var inputFile, conflictFile *os.File
-		defer func() {
-			if inputFile != nil {
-				inputFile.Close()
-			}
-		}()
-		defer func() {
-			if conflictFile != nil {
-				conflictFile.Close()
-			}
-		}()
+	// Else there is a conflict.
+	conflictKey := inputKey
+	conflictID := v.sourceID
 
-		// Skip dummy matches.
-		v, ok := entries[inputKey]
-		for ok && v.sourceID == nil && err != io.EOF {
-			err = rollingChecksum(&inputID, &inputKey, &inputFile)
+	for inputKey == conflictKey && err == nil {
+		// Set dummy value to mark the key as visited for future files.
+		a.entries.set(inputKey, fileMatch{})
 
-			if err != nil && err != io.EOF {
-				log.Println(err)
-				return nil
-			}
-			v, ok = entries[inputKey]
+		err = a.rollingChecksum(root, &inputID, &inputKey, &inputFile)
+		if err != nil && err != io.EOF {
+			// Read error. Drop input.
+			logf(a.Log, "%v", err)
+			return
 		}
 
-		if ok && v.sourceID == nil {
-			log.Printf("Source duplicate (%x) '%v'\n", inputKey.hash, inputID.path)
-			return nil
-		} else if !ok {
-			entries[inputKey] = fileMatch{sourceID: &inputID}
-			return nil
+		err = a.rollingChecksum(root, conflictID, &conflictKey, &conflictFile)
+		if err != nil && err != io.EOF {
+			// Read error. We will replace conflict with input.
+			logf(a.Log, "%v", err)
+			break
 		}
+	}
 
-		// Else there is a conflict.
-		conflictKey := inputKey
-		conflictID := entries[inputKey].sourceID
-
-		for inputKey == conflictKey && err == nil {
-			// Set dummy value to mark the key as visited for future files.
-			entries[inputKey] = fileMatch{}
-
-			err = rollingChecksum(&inputID, &inputKey, &inputFile)
-			if err != nil && err != io.EOF {
-				// Read error. Drop input.
-				log.Println(err)
-				return nil
-			}
-
-			err = rollingChecksum(conflictID, &conflictKey, &conflictFile)
-			if err != nil && err != io.EOF {
-				// Read error. We will replace conflict with input.
-				log.Println(err)
-				break
-			}
+	if inputKey == conflictKey && err == io.EOF {
+		// The partial hash is complete, 'conflictKey' may already hold
+		// duplicates.
+		logf(a.Log, "Source duplicate (%x) '%v'\n", inputKey.hash, inputID.path())
+		if len(v.sourceDups) == 0 {
+			logf(a.Log, "Source duplicate (%x) '%v'\n", conflictKey.hash, conflictID.path())
+		}
+		a.entries.set(inputKey, fileMatch{sourceID: conflictID, sourceDups: append(v.sourceDups, &inputID)})
+	} else {
+		// Resolved conflict.
+		a.entries.set(inputKey, fileMatch{sourceID: &inputID})
+		if err == nil || err == io.EOF {
+			// Re-add conflicting file except on read error.
+			a.entries.set(conflictKey, fileMatch{sourceID: conflictID})
 		}
+	}
+}
 
-		if inputKey == conflictKey && err == io.EOF {
-			entries[inputKey] = fileMatch{}
-			log.Printf("Source duplicate (%x) '%v'\n", inputKey.hash, inputID.path)
-			log.Printf("Source duplicate (%x) '%v'\n", conflictKey.hash, conflictID.path)
+// Analyze walks TARGET completely, matches its files against SOURCE and
+// returns the resulting plan.
+func (a *Analyzer) Analyze(root string) (Plan, error) {
+	resolved, err := resolveRoot(root)
+	if err != nil {
+		return Plan{}, err
+	}
+	var p Plan
+	var rejected map[string]string
+	if a.manifest != nil || a.sums != nil {
+		var matches []match
+		if a.manifest != nil {
+			matches, err = a.visitTargetManifest(resolved)
 		} else {
-			// Resolved conflict.
-			entries[inputKey] = fileMatch{sourceID: &inputID}
-			if err == nil || err == io.EOF {
-				// Re-add conflicting file except on read error.
-				entries[conflictKey] = fileMatch{sourceID: conflictID}
-			}
+			matches, err = a.visitTargetSums(resolved)
 		}
-
-		return nil
+		if err != nil {
+			return Plan{}, err
+		}
+		p = a.plan(matches, resolved)
+	} else {
+		entries, links, err := a.visitTarget(resolved)
+		if err != nil {
+			return Plan{}, err
+		}
+		matches := a.matches(entries)
+		if a.Verify {
+			matches, rejected = a.verify(matches, resolved)
+		}
+		p = a.plan(matches, resolved)
+		a.matchLinks(&p, links, entries)
 	}
-
-	// Since we do not stop on read errors while walking, the returned error is
-	// always nil.
-	_ = filepath.Walk(".", visitor)
+	if a.Folders {
+		a.collapseFolders(&p, resolved)
+	}
+	p.Target = root
+	p.Verified = a.Verify
+	p.MinSize = a.MinSize
+	p.MaxSize = a.MaxSize
+	if len(rejected) > 0 {
+		p.Rejected = rejected
+	}
+	return p, nil
 }
 
-// See comments in visitSource.
-func visitTarget(root, sourceRoot string, entries map[partialHash]fileMatch) {
-	oldroot, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
+// visitTarget returns the entries of SOURCE matched against 'root' and the
+// symbolic links of 'root'. The folders of 'root' that are SOURCE folders at
+// the same path, e.g. through a bind mount or a symbolic link, are not walked:
+// their files are the SOURCE files, in place. They are recorded as shared in
+// the entries. SOURCE folders found at another path are walked: their files
+// may have to move.
+func (a *Analyzer) visitTarget(root string) (*entryMap, *linkMap, error) {
+	if a.sourceRoot == "" {
+		return nil, nil, errNoSource
 	}
-	err = os.Chdir(root)
+	root, err := resolveRoot(root)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	defer os.Chdir(oldroot)
-
-	visitor := func(input string, info os.FileInfo, ignored error) error {
-		if !info.Mode().IsRegular() {
-			return nil
+	entries := a.cloneSource()
+	links := &linkMap{}
+	visitDir := func(input string, info os.FileInfo) bool {
+		id, err := identify(filepath.Join(root, input), info)
+		if err != nil {
+			logf(a.Log, "%v", err)
+			return true
 		}
-
-		if info.Size() == 0 {
-			return nil
+		if !a.sourceDirs.has(id, input) {
+			return true
 		}
-
-		inputID, inputKey := newFileEntry(input, info.Size())
-		var err error
-
-		var inputFile, conflictFile, sourceFile *os.File
-		defer func() {
-			if inputFile != nil {
-				inputFile.Close()
-			}
-		}()
-		defer func() {
-			if conflictFile != nil {
-				conflictFile.Close()
-			}
-		}()
-		defer func() {
-			if sourceFile != nil {
-				sourceFile.Close()
-			}
-		}()
-
-		// Skip dummy matches.
-		v, ok := entries[inputKey]
-		for ok && v.sourceID == nil && err != io.EOF {
-			err = rollingChecksum(&inputID, &inputKey, &inputFile)
-			if err != nil && err != io.EOF {
-				log.Println(err)
-				return nil
-			}
-			v, ok = entries[inputKey]
+		logf(a.Log, "Same folder as SOURCE, skip '%v'", input)
+		entries.share(input)
+		return false
+	}
+	err = a.walkTarget(root, visitDir, func(input string, info os.FileInfo) {
+		if isSymlink(info) {
+			a.visitLink(links, root, input)
+			return
 		}
+		a.visitTargetFile(entries, root, input, info)
+	})
+	return entries, links, err
+}
 
-		if ok && v.sourceID == nil {
-			log.Printf("Target duplicate match (%x) '%v'\n", inputKey.hash, inputID.path)
-			return nil
-		} else if ok && v.targetID != nil && v.targetID == &unsolvable {
-			// Unresolved conflict happened previously.
-			log.Printf("Target duplicate (%x) '%v', source match '%v'\n", inputKey.hash, inputID.path, v.sourceID.path)
-			return nil
-		} else if !ok {
-			// No matching file in source.
-			return nil
-		} else if v.targetID == nil {
-			// First match.
-			entries[inputKey] = fileMatch{sourceID: entries[inputKey].sourceID, targetID: &inputID}
-			return nil
+// See comments in visitSource.
+func (a *Analyzer) visitTargetFile(entries *entryMap, root, input string, info os.FileInfo) {
+	inputID, inputKey := a.newFileEntry(entries.paths, root, input, info)
+	var err error
+
+	var inputFile, conflictFile, sourceFile *os.File
+	defer func() {
+		if inputFile != nil {
+			inputFile.Close()
 		}
+	}()
+	defer func() {
+		if conflictFile != nil {
+			conflictFile.Close()
+		}
+	}()
+	defer func() {
+		if sourceFile != nil {
+			sourceFile.Close()
+		}
+	}()
+
+	// Skip dummy matches.
+	v, ok := entries.get(inputKey)
+	for ok && v.sourceID == nil && err != io.EOF {
+		err = a.rollingChecksum(root, &inputID, &inputKey, &inputFile)
+		if err != nil && err != io.EOF {
+			logf(a.Log, "%v", err)
+			return
+		}
+		v, ok = entries.get(inputKey)
+	}
 
-		// Else there is a conflict.
-		sourceKey := inputKey
-		sourceID := entries[inputKey].sourceID
-
-		conflictKey := inputKey
-		conflictID := entries[inputKey].targetID
-
-		for inputKey == conflictKey && inputKey == sourceKey && err == nil {
-			// Set dummy value to mark the key as visited for future files.
-			entries[inputKey] = fileMatch{}
-
-			// Since we change folders, we don't have to store the root in fileID, nor
-			// we have to compute sourceRoot's realpath to open the file from this
-			// point.
-			_ = os.Chdir(oldroot)
-			err = os.Chdir(sourceRoot)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			err = rollingChecksum(sourceID, &sourceKey, &sourceFile)
+	if ok && v.sourceID == nil {
+		logf(a.Log, "Target duplicate match (%x) '%v'\n", inputKey.hash, inputID.path())
+		return
+	} else if !ok {
+		// No matching file in source.
+		return
+	} else if v.targetID == nil {
+		// First match.
+		if len(v.sourceDups) > 0 {
+			logf(a.Log, "Target duplicate match (%x) '%v'\n", inputKey.hash, inputID.path())
+		}
+		entries.set(inputKey, fileMatch{sourceID: v.sourceID, sourceDups: v.sourceDups, targetID: &inputID})
+		return
+	}
 
-			_ = os.Chdir(oldroot)
-			err = os.Chdir(root)
-			if err != nil {
-				log.Fatal(err)
-			}
+	// Else there is a conflict.
+	sourceKey := inputKey
+	sourceID := v.sourceID
 
-			if err != nil && err != io.EOF {
-				// Read error. Drop all entries.
-				log.Println(err)
-				return nil
-			}
+	conflictKey := inputKey
+	conflictID := v.targetID
 
-			err = rollingChecksum(&inputID, &inputKey, &inputFile)
-			inputErr := err
-			if err != nil && err != io.EOF {
-				// Read error. Drop input.
-				log.Println(err)
-				// We don't break now as there is still a chance that the conflicting
-				// file matches the source.
-			}
+	for inputKey == conflictKey && inputKey == sourceKey && err == nil {
+		// Set dummy value to mark the key as visited for future files.
+		entries.set(inputKey, fileMatch{})
 
-			err = rollingChecksum(conflictID, &conflictKey, &conflictFile)
-			if err != nil && err != io.EOF {
-				// Read error. We will replace conflict with input if the latter has
-				// been read correctly.
-				log.Println(err)
-				break
-			}
+		err = a.rollingChecksum(a.sourceRoot, sourceID, &sourceKey, &sourceFile)
+		if err != nil && err != io.EOF {
+			// Read error. Drop all entries.
+			logf(a.Log, "%v", err)
+			return
+		}
 
-			if inputErr != nil && inputErr != io.EOF {
-				break
-			}
+		err = a.rollingChecksum(root, &inputID, &inputKey, &inputFile)
+		inputErr := err
+		if err != nil && err != io.EOF {
+			// Read error. Drop input.
+			logf(a.Log, "%v", err)
+			// We don't break now as there is still a chance that the conflicting
+			// file matches the source.
 		}
 
-		if inputKey == sourceKey && inputKey == conflictKey && err == io.EOF {
-			log.Printf("Target duplicate (%x) '%v', source match '%v'\n", inputKey.hash, inputID.path, v.sourceID.path)
-			log.Printf("Target duplicate (%x) '%v', source match '%v'\n", conflictKey.hash, conflictID.path, v.sourceID.path)
-			// We mark the source file with an unresolved conflict for future target files.
-			entries[sourceKey] = fileMatch{sourceID: sourceID, targetID: &unsolvable}
-		} else if inputKey == sourceKey && inputKey != conflictKey {
-			// Resolution: drop conflicting entry.
-			entries[sourceKey] = fileMatch{sourceID: sourceID, targetID: &inputID}
-		} else if conflictKey == sourceKey && conflictKey != inputKey {
-			// Resolution: drop input entry.
-			entries[sourceKey] = fileMatch{sourceID: sourceID, targetID: conflictID}
-		} else if conflictKey != sourceKey && inputKey != sourceKey {
-			// Resolution: drop both entries.
-			entries[sourceKey] = fileMatch{sourceID: sourceID}
+		err = a.rollingChecksum(root, conflictID, &conflictKey, &conflictFile)
+		if err != nil && err != io.EOF {
+			// Read error. We will replace conflict with input if the latter has
+			// been read correctly.
+			logf(a.Log, "%v", err)
+			break
 		}
-		// Else we drop all entries.
 
-		return nil
+		if inputErr != nil && inputErr != io.EOF {
+			break
+		}
 	}
 
-	_ = filepath.Walk(".", visitor)
-}
-
-// Rename files as specified in renameOps.
-// Chains and cycles may occur. See the implementation details.
-func processRenames(root string, renameOps, reverseOps map[string]string, clobber bool) {
-	// Change folder since the renames are made relatively to 'root'.
-	oldroot, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = os.Chdir(root)
-	if err != nil {
-		log.Fatal(err)
+	if inputKey == sourceKey && inputKey == conflictKey && err == io.EOF {
+		// The partial hash is complete: the TARGET files are duplicates. If the
+		// key was already complete, it may hold SOURCE and TARGET duplicates.
+		logf(a.Log, "Target duplicate (%x) '%v', source match '%v'\n", inputKey.hash, inputID.path(), v.sourceID.path())
+		if len(v.targetDups) == 0 {
+			logf(a.Log, "Target duplicate (%x) '%v', source match '%v'\n", conflictKey.hash, conflictID.path(), v.sourceID.path())
+		}
+		entries.set(sourceKey, fileMatch{
+			sourceID:   sourceID,
+			sourceDups: v.sourceDups,
+			targetID:   conflictID,
+			targetDups: append(v.targetDups, &inputID),
+		})
+	} else if inputKey == sourceKey && inputKey != conflictKey {
+		// Resolution: drop conflicting entry.
+		entries.set(sourceKey, fileMatch{sourceID: sourceID, targetID: &inputID})
+	} else if conflictKey == sourceKey && conflictKey != inputKey {
+		// Resolution: drop input entry.
+		entries.set(sourceKey, fileMatch{sourceID: sourceID, targetID: conflictID})
+	} else if conflictKey != sourceKey && inputKey != sourceKey {
+		// Resolution: drop both entries.
+		entries.set(sourceKey, fileMatch{sourceID: sourceID})
 	}
-	defer os.Chdir(oldroot)
+	// Else we drop all entries.
+}
 
-	for oldpath, newpath := range renameOps {
-		if oldpath == newpath {
+// matches returns the pairs of matching files. Entries with duplicates are
+// skipped, unless a.Duplicates is set.
+func (a *Analyzer) matches(entries *entryMap) []match {
+	var result []match
+	for k, v := range entries.m {
+		if v.sourceID == nil || v.targetID == nil {
 			continue
 		}
-
-		cycleMarker := oldpath
-
-		// Go forward to the end of the chain or the cycle.
-		for newpath != cycleMarker {
-			_, ok := renameOps[newpath]
-			if !ok {
-				break
-			}
-			oldpath = newpath
-			newpath = renameOps[newpath]
+		shared := false
+		if len(entries.shared) > 0 {
+			v, shared = unshare(v, entries)
 		}
-
-		// If cycle, break it down to a chain.
-		if cycleMarker == newpath {
-			f, err := ioutil.TempFile(".", application)
-			if err != nil {
-				log.Fatal(err)
+		switch {
+		case v.sourceID == nil:
+			// The SOURCE files are all in place already.
+			for _, fid := range append([]*fileID{v.targetID}, v.targetDups...) {
+				logf(a.Log, "Target duplicate (%x) '%v'", k.hash, fid.path())
 			}
-			tmp := f.Name()
-			f.Close()
-
-			err = os.Rename(oldpath, tmp)
-			if err != nil {
-				log.Println(err)
-			} else {
-				log.Printf("Rename '%v' -> '%v'", oldpath, tmp)
+		case !shared && len(v.sourceDups) == 0 && len(v.targetDups) == 0:
+			result = append(result, match{key: k, sourceID: v.sourceID, targetID: v.targetID})
+		case a.Duplicates:
+			result = append(result, a.pairDuplicates(k, v)...)
+		case shared:
+			// TARGET holds the file in place and elsewhere.
+			for _, fid := range append([]*fileID{v.targetID}, v.targetDups...) {
+				logf(a.Log, "Target duplicate (%x) '%v'", k.hash, fid.path())
 			}
-
-			// Plug temp file to the other end of the chain.
-			reverseOps[cycleMarker] = tmp
-
-			// During one loop over 'renameOps', we may process several operations in
-			// case of chains and cycles. Remove rename operation so that no other
-			// loop over 'renameOps' processes it again.
-			delete(renameOps, oldpath)
-			// Go backward.
-			newpath = oldpath
-			oldpath = reverseOps[oldpath]
 		}
+	}
+	return result
+}
 
-		// Process the chain of renames. Renaming can still fail, in which case we
-		// output the error and go on with the chain.
-		for oldpath != "" {
-			err = os.MkdirAll(filepath.Dir(newpath), 0777)
-			if err != nil {
-				log.Println(err)
-			} else {
-				// There is a race condition between the existence check and the rename.
-				// We could create a hard link to rename atomically without overwriting.
-				// But 1) we need to remove the original link afterward, so we lose
-				// atomicity, 2) hard links are not supported by all filesystems.
-				exists := false
-				if !clobber {
-					_, err = os.Stat(newpath)
-					if err == nil || os.IsExist(err) {
-						exists = true
-					}
-				}
-				if clobber || !exists {
-					err := os.Rename(oldpath, newpath)
-					if err != nil {
-						log.Println(err)
-					} else {
-						log.Printf("Rename '%v' -> '%v'", oldpath, newpath)
-					}
-				} else {
-					log.Printf("Destination exists, skip renaming: '%v' -> '%v'", oldpath, newpath)
-				}
-			}
-
-			delete(renameOps, oldpath)
-			newpath = oldpath
-			oldpath = reverseOps[oldpath]
+// unshare removes the SOURCE files in shared folders from 'v': they are paired
+// with themselves already. It reports whether some were removed. The SOURCE
+// file of the result is nil if none is left.
+func unshare(v fileMatch, entries *entryMap) (fileMatch, bool) {
+	var sources []*fileID
+	for _, fid := range append([]*fileID{v.sourceID}, v.sourceDups...) {
+		if !entries.isShared(fid.path()) {
+			sources = append(sources, fid)
 		}
 	}
+	if len(sources) == len(v.sourceDups)+1 {
+		return v, false
+	}
+	v.sourceID, v.sourceDups = nil, nil
+	if len(sources) > 0 {
+		v.sourceID, v.sourceDups = sources[0], sources[1:]
+	}
+	return v, true
 }
 
-func init() {
-	log.SetFlags(0)
-}
+// pairDuplicates pairs the SOURCE and TARGET duplicates of 'v'. Renames are
+// minimized by keeping the TARGET files that are already at the path of a
+// SOURCE duplicate in place. The files that remain unpaired are reported.
+func (a *Analyzer) pairDuplicates(key partialHash, v fileMatch) []match {
+	sources := append([]*fileID{v.sourceID}, v.sourceDups...)
+	targets := append([]*fileID{v.targetID}, v.targetDups...)
 
-func main() {
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %v SOURCE TARGET\n\n", os.Args[0])
-		fmt.Fprintln(os.Stderr, usage)
-		fmt.Fprintln(os.Stderr, "Options:")
-		flag.PrintDefaults()
+	inPlace := make(map[string]bool)
+	for _, fid := range sources {
+		inPlace[fid.path()] = false
 	}
-
-	var flagClobber = flag.Bool("f", false, "Overwrite existing files in TARGETS.")
-	var flagProcess = flag.Bool("p", false, "Rename the files in TARGETS.")
-	var flagVersion = flag.Bool("v", false, "Print version and exit.")
-	flag.Parse()
-	if *flagVersion {
-		fmt.Println(application, version, copyright)
-		return
+	var result []match
+	var targetsLeft []*fileID
+	for _, fid := range targets {
+		if _, ok := inPlace[fid.path()]; ok {
+			inPlace[fid.path()] = true
+			result = append(result, match{key: key, sourceID: fid, targetID: fid})
+		} else {
+			targetsLeft = append(targetsLeft, fid)
+		}
 	}
-
-	if flag.Arg(0) == "" || flag.Arg(1) == "" {
-		flag.Usage()
-		return
+	var sourcesLeft []*fileID
+	for _, fid := range sources {
+		if !inPlace[fid.path()] {
+			sourcesLeft = append(sourcesLeft, fid)
+		}
 	}
 
-	renameOps := make(map[string]string)
-	reverseOps := make(map[string]string)
-	s, err := os.Stat(flag.Arg(0))
-	if err != nil {
-		log.Fatal(err)
-	}
+	// Sort to make the plan deterministic.
+	sort.Slice(sourcesLeft, func(i, j int) bool { return sourcesLeft[i].path() < sourcesLeft[j].path() })
+	sort.Slice(targetsLeft, func(i, j int) bool { return targetsLeft[i].path() < targetsLeft[j].path() })
 
-	if s.IsDir() {
-		entries := make(map[partialHash]fileMatch)
-		log.Printf(":: Analyzing '%v'", flag.Arg(0))
-		visitSource(flag.Arg(0), entries)
-		log.Printf(":: Analyzing '%v'", flag.Arg(1))
-		visitTarget(flag.Arg(1), flag.Arg(0), entries)
+	for len(sourcesLeft) > 0 && len(targetsLeft) > 0 {
+		result = append(result, match{key: key, sourceID: sourcesLeft[0], targetID: targetsLeft[0]})
+		sourcesLeft, targetsLeft = sourcesLeft[1:], targetsLeft[1:]
+	}
+	for _, fid := range targetsLeft {
+		logf(a.Log, "Target duplicate left unmatched (%x) '%v'", key.hash, fid.path())
+	}
+	for _, fid := range sourcesLeft {
+		logf(a.Log, "Source duplicate left unmatched (%x) '%v'", key.hash, fid.path())
+	}
+	return result
+}
 
-		for _, v := range entries {
-			if v.targetID != nil && v.targetID != &unsolvable && v.targetID.path != v.sourceID.path {
-				renameOps[v.targetID.path] = v.sourceID.path
-				reverseOps[v.sourceID.path] = v.targetID.path
-			}
+// plan generates the renames from the matches in 'root'. In-place matches are
+// dropped to spare a lot of noise. If 'root' is empty, TARGET is not local and
+// the fingerprints are only set when the partial hash gives them.
+func (a *Analyzer) plan(matches []match, root string) Plan {
+	p := Plan{Hash: a.Hash, Renames: make(map[string]string), Matches: make(map[string]Match)}
+	for _, m := range matches {
+		if m.targetID.path() == m.sourceID.path() {
+			continue
 		}
-	} else {
-		buf, err := ioutil.ReadFile(flag.Arg(0))
-		if err != nil {
-			log.Fatal(err)
+		fp := ""
+		if root != "" || m.key.pos == 1 {
+			fp = a.fingerprint(m, root)
 		}
-		err = json.Unmarshal(buf, &renameOps)
-		if err != nil {
-			log.Fatal(err)
+		real := ""
+		if a.Follow && root != "" {
+			real = realPath(root, m.targetID.path())
 		}
-
-		for oldpath, newpath := range renameOps {
-			if oldpath == newpath {
-				delete(renameOps, oldpath)
-				continue
-			}
-			_, err := os.Stat(flag.Arg(1) + separator + oldpath)
-			if err != nil && os.IsNotExist(err) {
-				// Remove non-existing entries.
-				delete(renameOps, oldpath)
-				continue
-			}
-			reverseOps[newpath] = oldpath
+		p.Renames[m.targetID.path()] = m.sourceID.path()
+		p.Matches[m.targetID.path()] = Match{
+			Size:        m.key.size,
+			Pos:         m.key.pos,
+			Hash:        hex.EncodeToString([]byte(m.key.hash)),
+			Verified:    a.Verify,
+			Fingerprint: fp,
+			Real:        real,
 		}
 	}
+	return p
+}
 
-	if *flagProcess {
-		log.Println(":: Processing renames")
-		processRenames(flag.Arg(1), renameOps, reverseOps, *flagClobber)
-	} else {
-		log.Println(":: Previewing renames")
-		// There should be no error.
-		buf, _ := json.MarshalIndent(renameOps, "", "\t")
-		// Failure means fatal I/O error, no need to handle it.
-		_, _ = os.Stdout.Write(buf)
-		fmt.Println()
+// realPath returns the real path of the file 'path' of 'root' if one of its
+// folders is a symbolic link, or an empty string. The file itself may be a
+// link: it is not resolved.
+func realPath(root, path string) string {
+	dir := filepath.Join(root, filepath.Dir(path))
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil || real == dir {
+		return ""
+	}
+	return filepath.Join(real, filepath.Base(path))
+}
+
+// fingerprint returns the fingerprint of the TARGET file of 'm'. The file is
+// read only if the digest of its first block is not known yet.
+func (a *Analyzer) fingerprint(m match, root string) string {
+	if m.key.pos == 1 {
+		return hex.EncodeToString([]byte(m.key.hash))
+	}
+	if m.targetID.cache != nil {
+		if sum, ok := m.targetID.cache.lookup(0); ok {
+			return hex.EncodeToString(sum)
+		}
+	}
+	fp, err := fingerprint(a.newHash(), filepath.Join(root, m.targetID.path()))
+	if err != nil {
+		logf(a.Log, "%v", err)
 	}
+	return fp
 }
@@ -17,27 +17,50 @@ Manual tests for target:
 - Read errors.
 - Stat errors.
 */
-package main
+package hsync
 
 import (
 	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
+// testID returns the fileID of 'path'.
+func testID(path string) *fileID {
+	fid := newPathTable().id(path)
+	return &fid
+}
+
+// uniqueTarget returns the TARGET match of 'v' if there are no duplicates.
+// Duplicates are skipped by default, as if there were no match.
+func uniqueTarget(v fileMatch) *fileID {
+	if len(v.sourceDups) > 0 || len(v.targetDups) > 0 {
+		return nil
+	}
+	return v.targetID
+}
+
 func printEntries(entries map[partialHash]fileMatch) {
 	hashformat := "%x"
 	for k, v := range entries {
-		if v.sourceID != nil {
+		if v.sourceID != nil && len(v.sourceDups) == 0 {
 			// `partialHash.hash` is not in hex in the main program, but for
 			// convenience we store them in hex here.
-			if v.sourceID.h == nil {
+			if v.sourceID.state == nil {
 				hashformat = "%v"
 			}
 
-			if v.targetID != nil && v.targetID != &unsolvable {
-				fmt.Printf("%vB %v("+hashformat+"): %v -> %v\n", k.size, k.pos, k.hash, v.targetID.path, v.sourceID.path)
+			if uniqueTarget(v) != nil {
+				fmt.Printf("%vB %v("+hashformat+"): %v -> %v\n", k.size, k.pos, k.hash, v.targetID.path(), v.sourceID.path())
 			} else {
-				fmt.Printf("%vB %v("+hashformat+"): %v\n", k.size, k.pos, k.hash, v.sourceID.path)
+				fmt.Printf("%vB %v("+hashformat+"): %v\n", k.size, k.pos, k.hash, v.sourceID.path())
 			}
 		}
 	}
@@ -46,15 +69,16 @@ func printEntries(entries map[partialHash]fileMatch) {
 func sameEntries(got, want map[partialHash]fileMatch) bool {
 	count := 0
 	for k, v := range got {
-		if v.sourceID != nil {
+		if v.sourceID != nil && len(v.sourceDups) == 0 {
 			count++
 			hash := fmt.Sprintf("%x", k.hash)
 
+			target := uniqueTarget(v)
 			w, ok := want[partialHash{size: k.size, pos: k.pos, hash: hash}]
-			if !ok || v.sourceID.path != w.sourceID.path ||
-				((v.targetID == nil || v.targetID == &unsolvable) && w.targetID != nil) ||
-				((v.targetID != nil && v.targetID != &unsolvable) && w.targetID == nil) ||
-				(w.targetID != nil && v.targetID.path != w.targetID.path) {
+			if !ok || v.sourceID.path() != w.sourceID.path() ||
+				(target == nil && w.targetID != nil) ||
+				(target != nil && w.targetID == nil) ||
+				(w.targetID != nil && target.path() != w.targetID.path()) {
 				return false
 			}
 		}
@@ -85,25 +109,30 @@ func TestVisit(t *testing.T) {
 	source := "./testdata/src"
 	target := "./testdata/tgt"
 
-	entries := make(map[partialHash]fileMatch)
-
-	visitSource(source, entries)
-	visitTarget(target, source, entries)
+	a := NewAnalyzer()
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	e, _, err := a.visitTarget(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := e.m
 
 	// Remove in-place renames.
 	for k, v := range entries {
-		if v.targetID != nil && v.targetID.path == v.sourceID.path {
+		if v.targetID != nil && v.targetID.path() == v.sourceID.path() {
 			delete(entries, k)
 		}
 	}
 
 	want := map[partialHash]fileMatch{
-		{size: 1}: {sourceID: &fileID{path: "1"}},
-		{size: 4, pos: 1, hash: "b59c67bf196a4758191e42f76670ceba"}: {sourceID: &fileID{path: "4s1"}},
-		{size: 4, pos: 1, hash: "934b535800b1cba8f96a5d72f72f1611"}: {sourceID: &fileID{path: "sub/4s2"}, targetID: &fileID{path: "folder/4d2"}},
-		{size: 5, pos: 1, hash: "b0baee9d279d34fa1dfd71aadb908c3f"}: {sourceID: &fileID{path: "5s1"}},
-		{size: 5, pos: 1, hash: "3d2172418ce305c7d16d4b05597c6a59"}: {sourceID: &fileID{path: "5s2"}},
-		{size: 6, pos: 1, hash: "96e79218965eb72c92a549dd5a330112"}: {sourceID: &fileID{path: "6"}},
+		{size: 1}: {sourceID: testID("1")},
+		{size: 4, pos: 1, hash: "b59c67bf196a4758191e42f76670ceba"}: {sourceID: testID("4s1")},
+		{size: 4, pos: 1, hash: "934b535800b1cba8f96a5d72f72f1611"}: {sourceID: testID("sub/4s2"), targetID: testID("folder/4d2")},
+		{size: 5, pos: 1, hash: "b0baee9d279d34fa1dfd71aadb908c3f"}: {sourceID: testID("5s1")},
+		{size: 5, pos: 1, hash: "3d2172418ce305c7d16d4b05597c6a59"}: {sourceID: testID("5s2")},
+		{size: 6, pos: 1, hash: "96e79218965eb72c92a549dd5a330112"}: {sourceID: testID("6")},
 	}
 
 	if !sameEntries(entries, want) {
@@ -114,3 +143,357 @@ func TestVisit(t *testing.T) {
 		printEntries(want)
 	}
 }
+
+func TestVisitParallel(t *testing.T) {
+	source := "./testdata/src"
+	target := "./testdata/tgt"
+
+	var plans []Plan
+	for _, jobs := range []int{1, 8} {
+		a := NewAnalyzer()
+		a.Jobs = jobs
+		a.Log = log.New(ioutil.Discard, "", 0)
+		if err := a.VisitSource(source); err != nil {
+			t.Fatal(err)
+		}
+		p, err := a.Analyze(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plans = append(plans, p)
+	}
+
+	if !reflect.DeepEqual(plans[0], plans[1]) {
+		t.Errorf("Parallel plan %v differs from sequential plan %v", plans[1], plans[0])
+	}
+}
+
+func TestWalkLess(t *testing.T) {
+	paths := []string{"a", "a/b", "a/b/c", "a.b", "b"}
+	for i := range paths {
+		for j := range paths {
+			if got := walkLess(paths[i], paths[j]); got != (i < j) {
+				t.Errorf("walkLess(%q, %q) = %v", paths[i], paths[j], got)
+			}
+		}
+	}
+}
+
+// Conflicts in one TARGET must not affect the analysis of the others.
+func TestMultipleTargets(t *testing.T) {
+	a := NewAnalyzer()
+	a.Log = log.New(ioutil.Discard, "", 0)
+	if err := a.VisitSource("./testdata/src"); err != nil {
+		t.Fatal(err)
+	}
+
+	var plans []Plan
+	for i := 0; i < 2; i++ {
+		p, err := a.Analyze("./testdata/tgt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plans = append(plans, p)
+	}
+
+	want := map[string]string{"folder/4d2": "sub/4s2"}
+	for _, p := range plans {
+		if !reflect.DeepEqual(p.Renames, want) {
+			t.Errorf("Got plan %v, want %v", p.Renames, want)
+		}
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	source := writeTree(t, map[string]string{"a": "dup!", "b": "dup!", "c": "dup!", "s": "unique"})
+	defer os.RemoveAll(source)
+	target := writeTree(t, map[string]string{"a": "dup!", "w": "dup!", "y": "dup!", "z": "dup!", "t": "unique"})
+	defer os.RemoveAll(target)
+
+	for _, duplicates := range []bool{false, true} {
+		a := NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		a.Duplicates = duplicates
+		if err := a.VisitSource(source); err != nil {
+			t.Fatal(err)
+		}
+		p, err := a.Analyze(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{"t": "s"}
+		if duplicates {
+			// 'a' is kept in place, 'z' is left over.
+			want["w"] = "b"
+			want["y"] = "c"
+		}
+		if !reflect.DeepEqual(p.Renames, want) {
+			t.Errorf("Duplicates=%v: got renames %v, want %v", duplicates, p.Renames, want)
+		}
+	}
+}
+
+func TestSharedFolders(t *testing.T) {
+	source := writeTree(t, map[string]string{"shared/a": "dup!", "shared/b": "b", "dup/a": "dup!", "c": "c"})
+	defer os.RemoveAll(source)
+	// The shared folder is reached through a link, as through a bind mount.
+	target := writeTree(t, map[string]string{"copy": "dup!", "old/c": "c"})
+	defer os.RemoveAll(target)
+	writeLinks(t, target, map[string]string{"shared": filepath.Join(source, "shared")})
+
+	for _, duplicates := range []bool{false, true} {
+		a := NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		a.Follow = true
+		a.Duplicates = duplicates
+		if err := a.VisitSource(source); err != nil {
+			t.Fatal(err)
+		}
+		e, _, err := a.visitTarget(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]bool{"shared": true}; !reflect.DeepEqual(e.shared, want) {
+			t.Errorf("Got shared folders %v, want %v", e.shared, want)
+		}
+		p, err := a.Analyze(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{"old/c": "c"}
+		if duplicates {
+			// 'shared/a' is in place.
+			want["copy"] = "dup/a"
+		}
+		if !reflect.DeepEqual(p.Renames, want) {
+			t.Errorf("Duplicates=%v: got renames %v, want %v", duplicates, p.Renames, want)
+		}
+	}
+}
+
+// A SOURCE folder found at another path in TARGET is walked.
+func TestMovedSharedFolder(t *testing.T) {
+	target := writeTree(t, map[string]string{"old/a": "a", "old/b": "b"})
+	defer os.RemoveAll(target)
+	source := writeTree(t, map[string]string{"c": "c"})
+	defer os.RemoveAll(source)
+	writeLinks(t, source, map[string]string{"new": filepath.Join(target, "old")})
+
+	a := NewAnalyzer()
+	a.Log = log.New(ioutil.Discard, "", 0)
+	a.Follow = true
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Analyze(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"old/a": "new/a", "old/b": "new/b"}
+	if !reflect.DeepEqual(p.Renames, want) {
+		t.Errorf("Got renames %v, want %v", p.Renames, want)
+	}
+}
+
+// A SOURCE folder reached through several paths is shared under any of them,
+// whatever the order of the walk.
+func TestSharedFolderPaths(t *testing.T) {
+	source := writeTree(t, map[string]string{"a/x": "x", "c": "c"})
+	defer os.RemoveAll(source)
+	writeLinks(t, source, map[string]string{"b": "a"})
+	target := writeTree(t, map[string]string{"c": "c"})
+	defer os.RemoveAll(target)
+	writeLinks(t, target, map[string]string{"b": filepath.Join(source, "a")})
+
+	for _, jobs := range []int{1, 4} {
+		a := NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		a.Follow = true
+		a.Jobs = jobs
+		if err := a.VisitSource(source); err != nil {
+			t.Fatal(err)
+		}
+		e, _, err := a.visitTarget(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]bool{"b": true}; !reflect.DeepEqual(e.shared, want) {
+			t.Errorf("%v jobs: got shared folders %v, want %v", jobs, e.shared, want)
+		}
+	}
+}
+
+func TestSizeThresholds(t *testing.T) {
+	source := writeTree(t, map[string]string{"s1": "1", "s22": "22", "s333": "333"})
+	defer os.RemoveAll(source)
+	target := writeTree(t, map[string]string{"t1": "1", "t22": "22", "t333": "333"})
+	defer os.RemoveAll(target)
+
+	a := NewAnalyzer()
+	a.Log = log.New(ioutil.Discard, "", 0)
+	a.MinSize = 2
+	a.MaxSize = 2
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Analyze(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]string{"t22": "s22"}; !reflect.DeepEqual(p.Renames, want) {
+		t.Errorf("Got renames %v, want %v", p.Renames, want)
+	}
+	if p.MinSize != 2 || p.MaxSize != 2 {
+		t.Errorf("Got thresholds %v, %v, want 2, 2", p.MinSize, p.MaxSize)
+	}
+}
+
+func TestPathTable(t *testing.T) {
+	paths := newPathTable()
+	a := paths.id("usr/share/doc/a")
+	b := paths.id("usr/share/doc/b")
+	c := paths.id("usr/share/c")
+	d := paths.id("d")
+	for fid, want := range map[*fileID]string{&a: "usr/share/doc/a", &b: "usr/share/doc/b", &c: "usr/share/c", &d: "d"} {
+		if got := fid.path(); got != want {
+			t.Errorf("Got path %q, want %q", got, want)
+		}
+	}
+	if a.dir != b.dir || c.dir != a.dir.parent {
+		t.Errorf("Folders are not shared")
+	}
+}
+
+// fakeInfo describes a file that does not exist.
+type fakeInfo struct {
+	name string
+	size int64
+}
+
+func (f fakeInfo) Name() string       { return f.name }
+func (f fakeInfo) Size() int64        { return f.size }
+func (f fakeInfo) Mode() os.FileMode  { return 0644 }
+func (f fakeInfo) ModTime() time.Time { return time.Time{} }
+func (f fakeInfo) IsDir() bool        { return false }
+func (f fakeInfo) Sys() interface{}   { return nil }
+
+// legacyID is the fileID as it was before the folders were interned and the
+// digest states marshaled: a full path and a live digest per file.
+type legacyID struct {
+	path string
+	h    hash.Hash
+}
+
+// heldPerFile returns the heap memory held by the result of 'fill', per file.
+func heldPerFile(files int, fill func() interface{}) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	v := fill()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(v)
+	return float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / float64(files)
+}
+
+// BenchmarkSourceMemory stores a synthetic SOURCE and reports the memory held
+// per file by the analyzer ('B/file'), by the fileIDs alone ('id-B/file') and
+// by the legacy fileIDs of the same files ('legacy-B/file'). In the 'distinct'
+// variant, a million files in ten thousand folders have distinct sizes so that
+// they are never read. In the 'colliding' variant, the files of a smaller tree
+// on disk share their size by pairs so that every file is rolled once and
+// stores its digest state. Run with '-benchtime 1x'.
+func BenchmarkSourceMemory(b *testing.B) {
+	const perFolder = 100
+	path := func(j int) string {
+		return fmt.Sprintf("usr/share/package-%05d/data/file-%04d.dat", j/perFolder, j%perFolder)
+	}
+	discard := log.New(ioutil.Discard, "", 0)
+	newHash, _ := lookupHash(DefaultHash)
+	block := make([]byte, blocksize)
+	rolled := newHash()
+	rolled.Write(block)
+	state := marshalState(rolled)
+
+	for _, tt := range []struct {
+		name      string
+		files     int
+		colliding bool
+	}{
+		{"distinct", 1000000, false},
+		{"colliding", 10000, true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			root := "/nonexistent"
+			if tt.colliding {
+				var err error
+				root, err = ioutil.TempDir("", application)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer os.RemoveAll(root)
+				for j := 0; j < tt.files; j++ {
+					name := filepath.Join(root, path(j))
+					if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+						b.Fatal(err)
+					}
+					// A distinct first block, the rest is sparse.
+					content := []byte(fmt.Sprintf("%08d", j))
+					if err := ioutil.WriteFile(name, content, 0666); err != nil {
+						b.Fatal(err)
+					}
+					if err := os.Truncate(name, int64(blocksize+1+j/2)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+
+			for i := 0; i < b.N; i++ {
+				b.ReportMetric(heldPerFile(tt.files, func() interface{} {
+					a := NewAnalyzer()
+					a.Log = discard
+					if tt.colliding {
+						if err := a.VisitSource(root); err != nil {
+							b.Fatal(err)
+						}
+						return a
+					}
+					a.newHash = newHash
+					a.sourceRoot = root
+					for j := 0; j < tt.files; j++ {
+						p := path(j)
+						a.visitSource(p, fakeInfo{name: filepath.Base(p), size: int64(j + 1)})
+					}
+					return a
+				}), "B/file")
+
+				b.ReportMetric(heldPerFile(tt.files, func() interface{} {
+					paths := newPathTable()
+					ids := make([]*fileID, tt.files)
+					for j := range ids {
+						fid := paths.id(path(j))
+						if tt.colliding {
+							fid.state = append([]byte(nil), state...)
+						}
+						ids[j] = &fid
+					}
+					return ids
+				}), "id-B/file")
+
+				b.ReportMetric(heldPerFile(tt.files, func() interface{} {
+					ids := make([]*legacyID, tt.files)
+					for j := range ids {
+						ids[j] = &legacyID{path: path(j), h: newHash()}
+						if tt.colliding {
+							ids[j].h.Write(block)
+						}
+					}
+					return ids
+				}), "legacy-B/file")
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFile is the name of the files holding the patterns of the files to
+// skip in their folder.
+const ignoreFile = ".hsyncignore"
+
+// An ignorePattern is a pattern of a .gitignore-like file. Paths are matched
+// with '/' as separator, relative to the root of the walk.
+// - 'base' is the folder of the ignore file the pattern comes from.
+// - 'glob' holds the path elements of the pattern. '**' matches any number of
+// elements.
+// - An anchored pattern matches the path relative to 'base', otherwise the base
+// name only.
+type ignorePattern struct {
+	base     string
+	glob     []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreRules are the patterns that apply to a folder, from the least to the
+// most important. The last matching pattern wins.
+type ignoreRules []ignorePattern
+
+// parseIgnorePattern parses 'line' with the .gitignore syntax. It returns false
+// if the line is blank or a comment.
+func parseIgnorePattern(base, line string) (ignorePattern, bool, error) {
+	p := ignorePattern{base: base}
+	line = strings.TrimSuffix(line, "\r")
+	trimmed := strings.TrimRight(line, " ")
+	if strings.HasSuffix(trimmed, `\`) && len(trimmed) < len(line) {
+		// Escaped trailing space.
+		trimmed += " "
+	}
+	line = trimmed
+	if line == "" || line[0] == '#' {
+		return p, false, nil
+	}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	p.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return p, false, nil
+	}
+	p.glob = strings.Split(line, "/")
+	for _, elem := range p.glob {
+		if _, err := path.Match(elem, ""); err != nil {
+			return p, false, fmt.Errorf("invalid pattern '%v': %v", line, err)
+		}
+	}
+	return p, true, nil
+}
+
+// match reports whether the pattern matches 'name', a path relative to the
+// root of the walk with '/' as separator.
+func (p *ignorePattern) match(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		name = name[len(p.base)+1:]
+	}
+	elems := strings.Split(name, "/")
+	if !p.anchored {
+		ok, _ := path.Match(p.glob[0], elems[len(elems)-1])
+		return ok
+	}
+	return matchElems(p.glob, elems)
+}
+
+// matchElems reports whether the path elements 'elems' match the elements of
+// 'glob'. A '**' matches zero or more elements, except at the end where it
+// matches at least one, like 'abc/**' in gitignore matches the content of
+// 'abc' only.
+func matchElems(glob, elems []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" && len(glob) == 1 {
+			return len(elems) > 0
+		}
+		if glob[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(glob[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], elems[0]); !ok {
+			return false
+		}
+		glob, elems = glob[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// ignored reports whether the last pattern matching 'name' excludes it.
+func (rules ignoreRules) ignored(name string, isDir bool) bool {
+	ignored := false
+	for i := range rules {
+		if rules[i].match(name, isDir) {
+			ignored = !rules[i].negate
+		}
+	}
+	return ignored
+}
+
+// A filter selects the files and folders of a walk.
+type filter struct {
+	include []ignorePattern
+	exclude ignoreRules
+	log     *log.Logger
+}
+
+func newFilter(include, exclude []string, l *log.Logger) (*filter, error) {
+	f := &filter{log: l}
+	for _, s := range include {
+		p, ok, err := parseIgnorePattern("", s)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			f.include = append(f.include, p)
+		}
+	}
+	for _, s := range exclude {
+		p, ok, err := parseIgnorePattern("", s)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			f.exclude = append(f.exclude, p)
+		}
+	}
+	return f, nil
+}
+
+// rules returns the rules of folder 'dir' in 'root', i.e. the rules of its
+// parent 'parent' followed by the patterns of its ignore file.
+func (f *filter) rules(root, dir string, parent ignoreRules) ignoreRules {
+	file, err := os.Open(filepath.Join(root, dir, ignoreFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf(f.log, "%v", err)
+		}
+		return parent
+	}
+	defer file.Close()
+
+	base := filepath.ToSlash(dir)
+	if base == "." {
+		base = ""
+	}
+	// Do not append to 'parent' in place: it is shared with the sibling
+	// folders.
+	rules := append(ignoreRules{}, parent...)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		p, ok, err := parseIgnorePattern(base, scanner.Text())
+		if err != nil {
+			logf(f.log, "%v: %v", file.Name(), err)
+			continue
+		}
+		if ok {
+			rules = append(rules, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logf(f.log, "%v", err)
+	}
+	return rules
+}
+
+// skip reports whether 'name', relative to the root of the walk, must be
+// skipped given the rules of its folder. The exclude patterns of the filter
+// come after the ignore files and thus take precedence. Include patterns only
+// apply to files: a file is included if it or one of its folders matches.
+func (f *filter) skip(rules ignoreRules, name string, isDir bool) bool {
+	name = filepath.ToSlash(name)
+	ignored := rules.ignored(name, isDir)
+	for i := range f.exclude {
+		if f.exclude[i].match(name, isDir) {
+			ignored = !f.exclude[i].negate
+		}
+	}
+	if ignored {
+		return true
+	}
+	if isDir || len(f.include) == 0 {
+		return false
+	}
+	for dir, isDir := name, false; dir != "."; dir, isDir = path.Dir(dir), true {
+		for i := range f.include {
+			if f.include[i].match(dir, isDir) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package hsync
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestIgnorePattern(t *testing.T) {
+	for _, tt := range []struct {
+		base, pattern, name string
+		isDir, want         bool
+	}{
+		{"", "*.o", "a.o", false, true},
+		{"", "*.o", "sub/a.o", false, true},
+		{"", "*.o", "a.c", false, false},
+		{"", "/*.o", "sub/a.o", false, false},
+		{"", "/*.o", "a.o", false, true},
+		{"", "cache/", "sub/cache", true, true},
+		{"", "cache/", "sub/cache", false, false},
+		{"", "doc/*.txt", "doc/a.txt", false, true},
+		{"", "doc/*.txt", "sub/doc/a.txt", false, false},
+		{"", "**/doc/*.txt", "sub/doc/a.txt", false, true},
+		{"", "a/**/b", "a/b", false, true},
+		{"", "a/**/b", "a/x/y/b", false, true},
+		{"", "a/**", "a/x/y", false, true},
+		{"", "a/**", "a", true, false},
+		{"", `\#hash`, "#hash", false, true},
+		{"sub", "/a", "sub/a", false, true},
+		{"sub", "/a", "sub/x/a", false, false},
+		{"sub", "x/a", "sub/x/a", false, true},
+	} {
+		p, ok, err := parseIgnorePattern(tt.base, tt.pattern)
+		if !ok || err != nil {
+			t.Errorf("Pattern %q: got %v, %v", tt.pattern, ok, err)
+			continue
+		}
+		if got := p.match(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("Pattern %q in %q on %q: got %v, want %v", tt.pattern, tt.base, tt.name, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment"} {
+		if _, ok, _ := parseIgnorePattern("", line); ok {
+			t.Errorf("Line %q: got a pattern", line)
+		}
+	}
+	if _, _, err := parseIgnorePattern("", "a["); err == nil {
+		t.Errorf("Pattern %q: want an error", "a[")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		".hsyncignore":        "*.tmp\n!keep.tmp\nbuild/\n",
+		"a.jpg":               "a",
+		"a.tmp":               "a",
+		"keep.tmp":            "a",
+		"build/a.jpg":         "a",
+		"sub/.hsyncignore":    "/b.jpg\n",
+		"sub/b.jpg":           "a",
+		"sub/c.jpg":           "a",
+		"sub/deep/b.jpg":      "a",
+		"sub/deep/x.tmp":      "a",
+		"photos/raw/a.cr2":    "a",
+		"photos/a.png":        "a",
+		".git/objects/abcdef": "a",
+	})
+	defer os.RemoveAll(root)
+
+	for _, tt := range []struct {
+		include, exclude []string
+		want             []string
+	}{
+		{nil, []string{".git"}, []string{".hsyncignore", "a.jpg", "keep.tmp", "photos/a.png", "photos/raw/a.cr2", "sub/.hsyncignore", "sub/c.jpg", "sub/deep/b.jpg"}},
+		{[]string{"*.jpg", "photos/raw"}, []string{".git", "sub/deep/"}, []string{"a.jpg", "photos/raw/a.cr2", "sub/c.jpg"}},
+		{[]string{"*.tmp"}, []string{"!a.tmp"}, []string{"a.tmp", "keep.tmp"}},
+		// 'photos' itself is not excluded, so its content can be included again.
+		{nil, []string{".git", "photos/**", "!photos/a.png"}, []string{".hsyncignore", "a.jpg", "keep.tmp", "photos/a.png", "sub/.hsyncignore", "sub/c.jpg", "sub/deep/b.jpg"}},
+	} {
+		for _, jobs := range []int{1, 4} {
+			a := NewAnalyzer()
+			a.Log = log.New(ioutil.Discard, "", 0)
+			a.Jobs = jobs
+			a.Include = tt.include
+			a.Exclude = tt.exclude
+			var mu sync.Mutex
+			var got []string
+			err := a.walk(root, nil, func(path string, info os.FileInfo) {
+				mu.Lock()
+				got = append(got, path)
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Include %q, exclude %q, %v jobs: got %q, want %q", tt.include, tt.exclude, jobs, got, tt.want)
+			}
+		}
+	}
+}
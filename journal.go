@@ -0,0 +1,402 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Journal operations.
+const (
+	opRename = "rename"
+	opMkdir  = "mkdir"
+	opRmdir  = "rmdir"
+	// The target of the symbolic link 'Path' is changed from 'Old' to 'New'.
+	opRelink = "relink"
+	// A temporary file 'Path' is created for the file 'Old' to break a cycle.
+	opTmp = "tmp"
+	// A temporary symbolic link 'Path' is created to rewrite the link 'Old'.
+	opTmpLink = "tmplink"
+	// The session completed.
+	opDone = "done"
+)
+
+// A journalEntry is one line of the journal. A session entry sets 'Root' and
+// 'Plan' and applies to the subsequent operations. Paths are relative to
+// 'Root'.
+type journalEntry struct {
+	Root    string            `json:"root,omitempty"`
+	Plan    map[string]string `json:"plan,omitempty"`
+	Folders []string          `json:"folders,omitempty"`
+	Links   map[string]string `json:"links,omitempty"`
+	Op      string            `json:"op,omitempty"`
+	Old     string            `json:"old,omitempty"`
+	New     string            `json:"new,omitempty"`
+	Path    string            `json:"path,omitempty"`
+}
+
+// A Journal records the operations processed by a Renamer so that they can be
+// undone or resumed. Every operation is written and synced to disk as soon as
+// it is processed, so that the journal is reliable even if the program gets
+// interrupted.
+type Journal struct {
+	f *os.File
+}
+
+// A Session is a run of a Renamer as recorded in a journal.
+type Session struct {
+	// Root is the absolute path of TARGET.
+	Root string
+
+	// Plan holds the renames the session was started with.
+	Plan Plan
+
+	// Done is true if the session completed.
+	Done bool
+
+	ops []journalEntry
+}
+
+// OpenJournal opens the journal at 'path' for appending, creating it if
+// needed.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{f: f}, nil
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+func (j *Journal) record(e journalEntry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = j.f.Write(buf)
+	if err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// ReadSessions returns the sessions recorded in the journal at 'path'. A
+// truncated last line, as left by an interruption, is ignored.
+func ReadSessions(path string, l *log.Logger) ([]*Session, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sessions []*Session
+	var s *Session
+	dec := json.NewDecoder(f)
+	for {
+		var e journalEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logf(l, "Journal '%v' is truncated: %v", path, err)
+			break
+		}
+		if e.Root != "" {
+			s = &Session{Root: e.Root, Plan: Plan{Renames: e.Plan, Folders: make(map[string]bool)}}
+			if s.Plan.Renames == nil {
+				s.Plan.Renames = make(map[string]string)
+			}
+			for _, dir := range e.Folders {
+				s.Plan.Folders[dir] = true
+			}
+			s.Plan.Links = e.Links
+			sessions = append(sessions, s)
+			continue
+		}
+		if s == nil {
+			// Operation without session: the journal is not ours.
+			continue
+		}
+		if e.Op == opDone {
+			s.Done = true
+			continue
+		}
+		s.ops = append(s.ops, e)
+	}
+	return sessions, nil
+}
+
+// inverse returns the operation that reverts 'e'. Temporary files are
+// reverted by removing them if they are still empty.
+func inverse(e journalEntry) journalEntry {
+	switch e.Op {
+	case opRename:
+		return journalEntry{Op: opRename, Old: e.New, New: e.Old}
+	case opMkdir:
+		return journalEntry{Op: opRmdir, Path: e.Path}
+	case opRmdir:
+		return journalEntry{Op: opMkdir, Path: e.Path}
+	case opRelink:
+		return journalEntry{Op: opRelink, Path: e.Path, Old: e.New, New: e.Old}
+	}
+	return e
+}
+
+// apply processes the operation in 'root'. Files are never overwritten.
+// Errors are reported to 'l'. It reports whether the operation succeeded.
+func apply(root string, e journalEntry, l *log.Logger) bool {
+	switch e.Op {
+	case opRename:
+		oldpath, newpath := filepath.Join(root, e.Old), filepath.Join(root, e.New)
+		err := os.MkdirAll(filepath.Dir(newpath), 0777)
+		if err != nil {
+			logf(l, "%v", err)
+			return false
+		}
+		err = renameNoClobber(oldpath, newpath)
+		if os.IsExist(err) {
+			logf(l, "Destination exists, skip renaming: '%v' -> '%v'", e.Old, e.New)
+			return false
+		}
+		if err != nil {
+			logf(l, "%v", err)
+			return false
+		}
+		logf(l, "Rename '%v' -> '%v'", e.Old, e.New)
+	case opMkdir:
+		err := os.Mkdir(filepath.Join(root, e.Path), 0777)
+		if err != nil {
+			logf(l, "%v", err)
+			return false
+		}
+		logf(l, "Create folder '%v'", e.Path)
+	case opRmdir:
+		// Only succeeds if the folder is empty.
+		err := os.Remove(filepath.Join(root, e.Path))
+		if err != nil {
+			logf(l, "%v", err)
+			return false
+		}
+		logf(l, "Remove folder '%v'", e.Path)
+	case opRelink:
+		target, err := os.Readlink(filepath.Join(root, e.Path))
+		if err != nil {
+			logf(l, "%v", err)
+			return false
+		}
+		if target != e.Old {
+			logf(l, "Symbolic link changed, skip relinking '%v'", e.Path)
+			return false
+		}
+		err = replaceLink(root, e.Path, e.New, nil)
+		if err != nil {
+			logf(l, "%v", err)
+			return false
+		}
+		logf(l, "Relink '%v': '%v' -> '%v'", e.Path, e.Old, e.New)
+	case opTmp:
+		return removeOrphan(root, e.Path, l)
+	case opTmpLink:
+		return removeOrphanLink(root, e.Path, l)
+	}
+	return true
+}
+
+// removeOrphan removes the temporary file or folder 'path' if it is empty.
+// Non-empty ones are kept since they hold the content of a TARGET file or
+// folder.
+func removeOrphan(root, path string, l *log.Logger) bool {
+	path = filepath.Join(root, path)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	empty := info.Mode().IsRegular() && info.Size() == 0 || info.IsDir() && isEmptyDir(path)
+	if !empty {
+		logf(l, "Temporary file '%v' is not empty, left in place", path)
+		return false
+	}
+	err = os.Remove(path)
+	if err != nil {
+		logf(l, "%v", err)
+		return false
+	}
+	logf(l, "Remove temporary file '%v'", path)
+	return true
+}
+
+// removeOrphanLink removes the temporary symbolic link 'path'.
+func removeOrphanLink(root, path string, l *log.Logger) bool {
+	path = filepath.Join(root, path)
+	info, err := os.Lstat(path)
+	if err != nil || !isSymlink(info) {
+		return false
+	}
+	err = os.Remove(path)
+	if err != nil {
+		logf(l, "%v", err)
+		return false
+	}
+	logf(l, "Remove temporary link '%v'", path)
+	return true
+}
+
+// Undo replays the journal at 'path' in reverse to restore the original
+// layout. Files are never overwritten: if the original path of a file is
+// taken, the file is left in place. Errors are reported to 'l', or the
+// standard logger if nil, and do not stop the processing.
+func Undo(path string, l *log.Logger) error {
+	sessions, err := ReadSessions(path, l)
+	if err != nil {
+		return err
+	}
+	for i := len(sessions) - 1; i >= 0; i-- {
+		s := sessions[i]
+		for j := len(s.ops) - 1; j >= 0; j-- {
+			apply(s.Root, inverse(s.ops[j]), l)
+		}
+	}
+	return nil
+}
+
+// remaining returns the plan of the renames of the session that have not been
+// processed, the temporary files and links that were created but not used, and
+// the symbolic links renamed but not rewritten yet, by new path.
+func (s *Session) remaining() (Plan, []journalEntry, map[string]string) {
+	p := Plan{Renames: make(map[string]string), Folders: make(map[string]bool), Links: make(map[string]string)}
+	for oldpath, newpath := range s.Plan.Renames {
+		p.Renames[oldpath] = newpath
+	}
+	for dir := range s.Plan.Folders {
+		p.Folders[dir] = true
+	}
+	for oldpath, target := range s.Plan.Links {
+		p.Links[oldpath] = target
+	}
+
+	var orphans []journalEntry
+	relinks := make(map[string]string)
+	for _, e := range s.ops {
+		switch e.Op {
+		case opTmp, opTmpLink:
+			orphans = append(orphans, e)
+		case opRelink:
+			delete(relinks, e.Path)
+			if p.Renames[e.Path] == e.Path {
+				// Rewritten in place.
+				delete(p.Renames, e.Path)
+				delete(p.Links, e.Path)
+			}
+		case opRename:
+			newpath, ok := p.Renames[e.Old]
+			if !ok {
+				continue
+			}
+			delete(p.Renames, e.Old)
+			if newpath != e.New {
+				// The file was moved to a temporary file to break a cycle.
+				p.Renames[e.New] = newpath
+				p.Folders[e.New] = p.Folders[e.Old]
+				if target, ok := p.Links[e.Old]; ok {
+					p.Links[e.New] = target
+				}
+			} else if target, ok := p.Links[e.Old]; ok {
+				relinks[newpath] = target
+			}
+			delete(p.Folders, e.Old)
+			delete(p.Links, e.Old)
+		}
+	}
+
+	// Temporary files that are still pending are not orphans.
+	var unused []journalEntry
+	for _, e := range orphans {
+		if _, ok := p.Renames[e.Path]; !ok || e.Op == opTmpLink {
+			unused = append(unused, e)
+		}
+	}
+	return p, unused, relinks
+}
+
+// Complete processes the renames of an interrupted session that were not
+// processed. r.Root is set to the root of the session. Temporary files left
+// empty by the interruption are removed. If the interruption happened between
+// the rename to a temporary file and its record, the temporary file is
+// plugged back into its cycle. Renamed symbolic links are rewritten if need
+// be.
+func (s *Session) Complete(r *Renamer) error {
+	r.Root = s.Root
+	if r.Prune {
+		// The folders emptied before the interruption.
+		for _, e := range s.ops {
+			if e.Op == opRename {
+				r.markEmptied(e.Old)
+			}
+		}
+	}
+	p, orphans, relinks := s.remaining()
+	for _, e := range orphans {
+		if e.Op == opTmpLink {
+			removeOrphanLink(s.Root, e.Path, r.Log)
+			continue
+		}
+		if removeOrphan(s.Root, e.Path, r.Log) {
+			continue
+		}
+		oldpath, tmp := e.Old, e.Path
+		newpath, ok := p.Renames[oldpath]
+		if _, err := os.Lstat(filepath.Join(s.Root, oldpath)); ok && os.IsNotExist(err) {
+			delete(p.Renames, oldpath)
+			p.Renames[tmp] = newpath
+			p.Folders[tmp] = p.Folders[oldpath]
+			delete(p.Folders, oldpath)
+			if target, ok := p.Links[oldpath]; ok {
+				p.Links[tmp] = target
+				delete(p.Links, oldpath)
+			}
+		}
+	}
+	for path, target := range relinks {
+		err := r.relink(path, target)
+		if err != nil {
+			return err
+		}
+	}
+	return r.Rename(p)
+}
+
+// Rollback reverts the operations of the session in reverse order and removes
+// the temporary files left empty. Reverted operations are recorded in
+// 'journal' if not nil.
+func (s *Session) Rollback(journal *Journal, l *log.Logger) error {
+	if journal != nil {
+		err := journal.record(journalEntry{Root: s.Root})
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(s.ops) - 1; i >= 0; i-- {
+		e := inverse(s.ops[i])
+		if apply(s.Root, e, l) && journal != nil && e.Op != opTmp && e.Op != opTmpLink {
+			err := journal.record(e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if journal != nil {
+		return journal.record(journalEntry{Op: opDone})
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package hsync
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readTree returns the content of all regular files in 'root' and the list
+// of folders. Symbolic links are skipped, see readLinks.
+func readTree(t *testing.T, root string) (files map[string]string, dirs []string) {
+	files = make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if info.IsDir() {
+			dirs = append(dirs, rel)
+			return nil
+		}
+		if isSymlink(info) {
+			return nil
+		}
+		buf, err := ioutil.ReadFile(path)
+		files[rel] = string(buf)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files, dirs
+}
+
+func TestUndo(t *testing.T) {
+	root, err := ioutil.TempDir("", application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	target := filepath.Join(root, "ren")
+	copyTree(t, "testdata/ren", target)
+	wantFiles, wantDirs := readTree(t, target)
+
+	f, err := os.Open("testdata/ren.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ReadPlan(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journalPath := filepath.Join(root, "journal")
+	journal, err := OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard := log.New(ioutil.Discard, "", 0)
+	r := Renamer{Root: target, Log: discard, Journal: journal}
+	if err := r.Rename(plan); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	if err := Undo(journalPath, discard); err != nil {
+		t.Fatal(err)
+	}
+
+	files, dirs := readTree(t, target)
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("Got files %v, want %v", files, wantFiles)
+	}
+	if !reflect.DeepEqual(dirs, wantDirs) {
+		t.Errorf("Got folders %v, want %v", dirs, wantDirs)
+	}
+}
+
+// replay processes the journal operation 'e' in 'root' as the Renamer did.
+func replay(t *testing.T, root string, e journalEntry) {
+	var err error
+	switch e.Op {
+	case opRename:
+		err = os.Rename(filepath.Join(root, e.Old), filepath.Join(root, e.New))
+	case opMkdir:
+		err = os.Mkdir(filepath.Join(root, e.Path), 0777)
+	case opTmp:
+		err = ioutil.WriteFile(filepath.Join(root, e.Path), nil, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	root, err := ioutil.TempDir("", application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	f, err := os.Open("testdata/ren.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ReadPlan(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard := log.New(ioutil.Discard, "", 0)
+
+	// Reference run.
+	target := filepath.Join(root, "ren")
+	copyTree(t, "testdata/ren", target)
+	origFiles, origDirs := readTree(t, target)
+	journalPath := filepath.Join(root, "journal")
+	journal, err := OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Renamer{Root: target, Log: discard, Journal: journal}
+	if err := r.Rename(plan); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+	wantFiles, wantDirs := readTree(t, target)
+	sessions, err := ReadSessions(journalPath, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || !sessions[0].Done {
+		t.Fatalf("Got sessions %+v, want one complete session", sessions)
+	}
+	ref := sessions[0]
+
+	// Interrupt the run after every operation. When 'lost' is set, the last
+	// operation is processed but not recorded, or for temporary files, recorded
+	// but not created.
+	for k := 0; k < len(ref.ops); k++ {
+		for _, lost := range []bool{false, true} {
+			for _, rollback := range []bool{false, true} {
+				if lost && rollback {
+					// Unrecorded operations cannot be reverted.
+					continue
+				}
+				target := filepath.Join(root, "interrupted")
+				os.RemoveAll(target)
+				copyTree(t, "testdata/ren", target)
+				journalPath := filepath.Join(root, "interrupted.journal")
+				os.Remove(journalPath)
+				journal, err := OpenJournal(journalPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = journal.record(journalEntry{Root: target, Plan: ref.Plan.Renames})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i <= k; i++ {
+					tmp := ref.ops[i].Op == opTmp
+					if !lost || i < k || !tmp {
+						replay(t, target, ref.ops[i])
+					}
+					if !lost || i < k || tmp {
+						if err := journal.record(ref.ops[i]); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+
+				sessions, err := ReadSessions(journalPath, discard)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := sessions[len(sessions)-1]
+				if s.Done {
+					t.Fatalf("Interrupted session is marked as done")
+				}
+				if rollback {
+					err = s.Rollback(journal, discard)
+				} else {
+					err = s.Complete(&Renamer{Log: discard, Journal: journal})
+				}
+				journal.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				files, dirs := readTree(t, target)
+				if rollback {
+					if !reflect.DeepEqual(files, origFiles) || !reflect.DeepEqual(dirs, origDirs) {
+						t.Errorf("Rollback after operation %v: got %v %v, want %v %v", k, files, dirs, origFiles, origDirs)
+					}
+				} else if !reflect.DeepEqual(files, wantFiles) || !reflect.DeepEqual(dirs, wantDirs) {
+					t.Errorf("Resume after operation %v (lost %v): got %v %v, want %v %v", k, lost, files, dirs, wantFiles, wantDirs)
+				}
+
+				sessions, err = ReadSessions(journalPath, discard)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !sessions[len(sessions)-1].Done {
+					t.Errorf("Resumed session is not marked as done")
+				}
+			}
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	target := writeTree(t, map[string]string{
+		"a/b/c/file": "1",
+		"a/other":    "2",
+		"d/file":     "3",
+	})
+	defer os.RemoveAll(target)
+	if err := os.MkdirAll(filepath.Join(target, "a/b/empty"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(target, "e/empty"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	wantFiles, wantDirs := readTree(t, target)
+
+	journalPath := target + ".journal"
+	defer os.Remove(journalPath)
+	journal, err := OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard := log.New(ioutil.Discard, "", 0)
+	r := Renamer{Root: target, Log: discard, Journal: journal, Prune: true}
+	p := Plan{Renames: map[string]string{"a/b/c/file": "x/file", "d/file": "file"}}
+	if err := r.Rename(p); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	// 'a/b' holds a folder that was empty already.
+	_, dirs := readTree(t, target)
+	if want := []string{".", "a", "a/b", "a/b/empty", "e", "e/empty", "x"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("Got folders %v, want %v", dirs, want)
+	}
+
+	if err := Undo(journalPath, discard); err != nil {
+		t.Fatal(err)
+	}
+	files, dirs := readTree(t, target)
+	if !reflect.DeepEqual(files, wantFiles) {
+		t.Errorf("Got files %v, want %v", files, wantFiles)
+	}
+	if !reflect.DeepEqual(dirs, wantDirs) {
+		t.Errorf("Got folders %v, want %v", dirs, wantDirs)
+	}
+}
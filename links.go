@@ -0,0 +1,134 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// A link is a symbolic link and its target.
+type link struct {
+	path, target string
+}
+
+// linkMap stores the symbolic links of a folder.
+type linkMap struct {
+	mu    sync.Mutex
+	links []link
+}
+
+func (l *linkMap) add(path, target string) {
+	l.mu.Lock()
+	l.links = append(l.links, link{path: path, target: target})
+	l.mu.Unlock()
+}
+
+func isSymlink(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+// visitLink stores the symbolic link 'input' of 'root' in 'links'.
+func (a *Analyzer) visitLink(links *linkMap, root, input string) {
+	target, err := os.Readlink(filepath.Join(root, input))
+	if err != nil {
+		logf(a.Log, "%v", err)
+		return
+	}
+	links.add(input, target)
+}
+
+// linkKey returns the key the symbolic link 'l' is matched by: its target, or
+// if RelocateLinks is set and the target is relative, the path it resolves to
+// relative to the root. 'renames', if not nil, maps the resolved path to its
+// new path.
+func (a *Analyzer) linkKey(l link, renames map[string]string) string {
+	if !a.RelocateLinks || filepath.IsAbs(l.target) {
+		return l.target
+	}
+	key := filepath.Join(filepath.Dir(l.path), l.target)
+	if newpath, ok := renames[key]; ok {
+		return newpath
+	}
+	return key
+}
+
+// matchLinks adds the renames of the symbolic links of TARGET to the plan.
+// Links are matched by key, see linkKey. When relocating, the links of TARGET
+// are resolved through the renames of the plan, so that a link still matches
+// when the file it points to gets renamed too. If the target of the matching
+// link in SOURCE differs, the link is rewritten with it once renamed.
+// Links with duplicates in either folder are skipped, as well as the SOURCE
+// links in the folders TARGET shares, see visitTarget.
+func (a *Analyzer) matchLinks(p *Plan, targetLinks *linkMap, entries *entryMap) {
+	sources := make(map[string][]link)
+	for _, l := range a.links.links {
+		if entries.isShared(l.path) {
+			continue
+		}
+		key := a.linkKey(l, nil)
+		sources[key] = append(sources[key], l)
+	}
+	targets := make(map[string][]link)
+	for _, l := range targetLinks.links {
+		key := a.linkKey(l, p.Renames)
+		targets[key] = append(targets[key], l)
+	}
+
+	for key, tl := range targets {
+		sl := sources[key]
+		if len(sl) == 0 {
+			continue
+		}
+		if len(sl) > 1 || len(tl) > 1 {
+			for _, l := range tl {
+				logf(a.Log, "Symbolic link duplicate (%v) '%v'", key, l.path)
+			}
+			continue
+		}
+		s, t := sl[0], tl[0]
+		if s.path == t.path && s.target == t.target {
+			continue
+		}
+		// Links in place are kept in the plan if they must be rewritten.
+		p.Renames[t.path] = s.path
+		if s.target != t.target {
+			if p.Links == nil {
+				p.Links = make(map[string]string)
+			}
+			p.Links[t.path] = s.target
+		}
+	}
+}
+
+// replaceLink sets the target of the symbolic link 'path' in 'root' to
+// 'target'. A new link is created under a temporary name, which is passed to
+// 'reserve' if not nil, then renamed over 'path'.
+func replaceLink(root, path, target string, reserve func(tmp string) error) error {
+	dir := filepath.Dir(path)
+	for i := 0; i < 10000; i++ {
+		tmp := filepath.Join(dir, application+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		if reserve != nil {
+			if err := reserve(tmp); err != nil {
+				return err
+			}
+		}
+		err := os.Symlink(target, filepath.Join(root, tmp))
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(root, tmp), filepath.Join(root, path))
+		if err != nil {
+			os.Remove(filepath.Join(root, tmp))
+		}
+		return err
+	}
+	return errTempFile
+}
@@ -0,0 +1,262 @@
+package hsync
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readLinks returns the target of all symbolic links in 'root'.
+func readLinks(t *testing.T, root string) map[string]string {
+	links := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !isSymlink(info) {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		links[rel], err = os.Readlink(path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return links
+}
+
+// writeLinks creates the symbolic links 'links' in 'root'.
+func writeLinks(t *testing.T, root string, links map[string]string) {
+	for path, target := range links {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	for _, tt := range []struct {
+		relocate bool
+		renames  map[string]string
+		links    map[string]string
+		want     map[string]string
+	}{
+		{
+			// Only 'abs' matches by target.
+			renames: map[string]string{"old/x": "data/x", "data/z": "z", "somewhere/abs": "abs"},
+			want: map[string]string{
+				"abs":       "/hsync/abs",
+				"data/y":    "y",
+				"old/sub/l": "../x",
+				"old/z":     "../data/z",
+				"unmatched": "nothing",
+			},
+		},
+		{
+			relocate: true,
+			renames: map[string]string{
+				"old/x":         "data/x",
+				"data/z":        "z",
+				"somewhere/abs": "abs",
+				"old/sub/l":     "data/l",
+				"old/z":         "old/z",
+			},
+			links: map[string]string{"old/sub/l": "x", "old/z": "../z"},
+			want: map[string]string{
+				"abs":       "/hsync/abs",
+				"data/l":    "x",
+				"data/y":    "y",
+				"old/z":     "../z",
+				"unmatched": "nothing",
+			},
+		},
+	} {
+		source := writeTree(t, map[string]string{"data/x": "xx", "z": "zzz"})
+		defer os.RemoveAll(source)
+		writeLinks(t, source, map[string]string{
+			"data/l": "x",
+			"data/y": "y",
+			"abs":    "/hsync/abs",
+			"old/z":  "../z",
+		})
+		target := writeTree(t, map[string]string{"old/x": "xx", "data/z": "zzz"})
+		defer os.RemoveAll(target)
+		// The link 'old/z' is in place but 'data/z' is renamed.
+		writeLinks(t, target, map[string]string{
+			"old/sub/l":     "../x",
+			"data/y":        "y",
+			"somewhere/abs": "/hsync/abs",
+			"old/z":         "../data/z",
+			"unmatched":     "nothing",
+		})
+		wantFiles, _ := readTree(t, target)
+		wantLinks := readLinks(t, target)
+
+		discard := log.New(ioutil.Discard, "", 0)
+		a := NewAnalyzer()
+		a.Log = discard
+		a.Symlinks = true
+		a.RelocateLinks = tt.relocate
+		if err := a.VisitSource(source); err != nil {
+			t.Fatal(err)
+		}
+		p, err := a.Analyze(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p.Renames, tt.renames) {
+			t.Errorf("Relocate %v: got renames %v, want %v", tt.relocate, p.Renames, tt.renames)
+		}
+		if !reflect.DeepEqual(p.Links, tt.links) {
+			t.Errorf("Relocate %v: got links %v, want %v", tt.relocate, p.Links, tt.links)
+		}
+
+		journalPath := target + ".journal"
+		defer os.Remove(journalPath)
+		journal, err := OpenJournal(journalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := Renamer{Root: target, Log: discard, Journal: journal}
+		if err := r.Rename(p); err != nil {
+			t.Fatal(err)
+		}
+		journal.Close()
+		if links := readLinks(t, target); !reflect.DeepEqual(links, tt.want) {
+			t.Errorf("Relocate %v: got symbolic links %v, want %v", tt.relocate, links, tt.want)
+		}
+
+		if err := Undo(journalPath, discard); err != nil {
+			t.Fatal(err)
+		}
+		if links := readLinks(t, target); !reflect.DeepEqual(links, wantLinks) {
+			t.Errorf("Relocate %v: got symbolic links %v after undo, want %v", tt.relocate, links, wantLinks)
+		}
+		if files, _ := readTree(t, target); !reflect.DeepEqual(files, wantFiles) {
+			t.Errorf("Relocate %v: got files %v after undo, want %v", tt.relocate, files, wantFiles)
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	source := writeTree(t, map[string]string{"local": "l"})
+	defer os.RemoveAll(source)
+	music := writeTree(t, map[string]string{"song": "song"})
+	defer os.RemoveAll(music)
+	// 'music/loop' leads back to 'music'.
+	writeLinks(t, source, map[string]string{"music": music})
+	writeLinks(t, music, map[string]string{"loop": "."})
+
+	target := writeTree(t, map[string]string{"song": "song"})
+	defer os.RemoveAll(target)
+	elsewhere := writeTree(t, map[string]string{"local": "l"})
+	defer os.RemoveAll(elsewhere)
+	// 'via' leads out of TARGET: it is not followed.
+	writeLinks(t, target, map[string]string{"via": elsewhere})
+
+	for _, jobs := range []int{1, 4} {
+		for _, follow := range []bool{false, true} {
+			discard := log.New(ioutil.Discard, "", 0)
+			a := NewAnalyzer()
+			a.Log = discard
+			a.Jobs = jobs
+			a.Follow = follow
+			if err := a.VisitSource(source); err != nil {
+				t.Fatal(err)
+			}
+			p, err := a.Analyze(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{}
+			if follow {
+				want = map[string]string{"song": "music/song"}
+			}
+			if !reflect.DeepEqual(p.Renames, want) {
+				t.Errorf("Follow %v with %v jobs: got renames %v, want %v", follow, jobs, p.Renames, want)
+			}
+		}
+	}
+}
+
+func TestFollowRealPath(t *testing.T) {
+	source := writeTree(t, map[string]string{"new": "content"})
+	defer os.RemoveAll(source)
+	// 'data' is only reached through 'inner'.
+	target := writeTree(t, map[string]string{"data/old": "content"})
+	defer os.RemoveAll(target)
+	writeLinks(t, target, map[string]string{"inner": "data"})
+
+	a := NewAnalyzer()
+	a.Log = log.New(ioutil.Discard, "", 0)
+	a.Follow = true
+	a.Exclude = []string{"/data"}
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Analyze(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"inner/old": "new"}; !reflect.DeepEqual(p.Renames, want) {
+		t.Fatalf("Got renames %v, want %v", p.Renames, want)
+	}
+	root, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Matches["inner/old"].Real, filepath.Join(root, "data", "old"); got != want {
+		t.Errorf("Got real path %q, want %q", got, want)
+	}
+}
+
+func TestOneFileSystem(t *testing.T) {
+	target := writeTree(t, map[string]string{"file": "file"})
+	defer os.RemoveAll(target)
+	// A folder on another filesystem is reached by following a link.
+	other, err := ioutil.TempDir("/dev/shm", application)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(other)
+	info, err := os.Stat(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootInfo, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, _, ok := fileIdentity(info)
+	rootDev, _, _ := fileIdentity(rootInfo)
+	if !ok || dev == rootDev {
+		t.Skip("no other filesystem")
+	}
+	if err := ioutil.WriteFile(filepath.Join(other, "mounted"), []byte("mounted"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	writeLinks(t, target, map[string]string{"mnt": other})
+
+	for _, oneFS := range []bool{false, true} {
+		a := NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		a.Follow = true
+		a.OneFileSystem = oneFS
+		var files []string
+		if err := a.walk(target, nil, func(path string, info os.FileInfo) { files = append(files, path) }); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"file", "mnt/mounted"}
+		if oneFS {
+			want = want[:1]
+		}
+		if !reflect.DeepEqual(files, want) {
+			t.Errorf("One filesystem %v: got %v, want %v", oneFS, files, want)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// manifestVersion is the version of the manifest format.
+const manifestVersion = 1
+
+// ErrNotManifest is returned by ReadManifest when the content is not a
+// manifest, e.g. a preview.
+var ErrNotManifest = errors.New("not a manifest")
+
+var (
+	errTwoManifests = errors.New("SOURCE and TARGET cannot both be manifests")
+	errVerifyListed = errors.New("matches cannot be verified against a manifest or a checksum list")
+	errWalkOnly     = errors.New("folders and symbolic links cannot be matched in a manifest TARGET")
+)
+
+// A Manifest describes the files of a folder by their size and partial hash,
+// so that the folder can be analyzed as SOURCE or TARGET where it is not
+// reachable. See Analyzer.Manifest.
+type Manifest struct {
+	// Root is the folder as passed to Analyzer.Manifest.
+	Root string
+
+	// Hash is the name of the checksum algorithm of the partial hashes.
+	Hash string
+
+	// Files is sorted by path.
+	Files []ManifestFile
+}
+
+// A ManifestFile is a file of a Manifest. Its partial hash is resolved enough
+// to tell it apart from the other files of the folder, unless they are
+// duplicates.
+type ManifestFile struct {
+	// Path is relative to the root of the manifest, with '/' as separator.
+	Path string `json:"path"`
+
+	Size int64 `json:"size"`
+
+	// Pos is the number of blocks hashed. It is the number of blocks of the
+	// file if it was hashed completely.
+	Pos int64 `json:"pos"`
+
+	// Hash is the partial hash of the file, in hexadecimal.
+	Hash string `json:"hash"`
+
+	// Fingerprint is the digest of the first block of the file, in
+	// hexadecimal. See Match.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// manifestFile is the JSON representation of a Manifest. 'Version' tells
+// manifests apart from previews.
+type manifestFile struct {
+	Version int            `json:"manifest"`
+	Root    string         `json:"root,omitempty"`
+	Hash    string         `json:"hash"`
+	Files   []ManifestFile `json:"files"`
+}
+
+// WriteManifest encodes the manifest to w in JSON. It can be read back with
+// ReadManifest.
+func WriteManifest(w io.Writer, m *Manifest) error {
+	// There should be no error.
+	buf, _ := json.MarshalIndent(manifestFile{
+		Version: manifestVersion,
+		Root:    m.Root,
+		Hash:    m.Hash,
+		Files:   m.Files,
+	}, "", "\t")
+	buf = append(buf, '\n')
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadManifest decodes a manifest written by WriteManifest. It returns
+// ErrNotManifest if the JSON content is not a manifest.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var f manifestFile
+	err := json.NewDecoder(r).Decode(&f)
+	if err != nil {
+		return nil, err
+	}
+	if f.Version == 0 {
+		return nil, ErrNotManifest
+	}
+	if f.Version > manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %v", f.Version)
+	}
+	return &Manifest{Root: f.Root, Hash: f.Hash, Files: f.Files}, nil
+}
+
+// complete reports whether the partial hash covers the whole file.
+func (k partialHash) complete() bool {
+	return k.pos*blocksize >= k.size
+}
+
+// normalize returns 'k' with the number of blocks of the file as position if
+// the partial hash is complete: the rolls past the end of the file do not
+// change the hash.
+func (k partialHash) normalize() partialHash {
+	if k.complete() {
+		k.pos = (k.size + blocksize - 1) / blocksize
+	}
+	return k
+}
+
+func closeFile(f *os.File) {
+	if f != nil {
+		f.Close()
+	}
+}
+
+// Manifest walks 'root' as SOURCE and returns its manifest. The files are
+// hashed as deep as needed to tell them apart, and at least 'depth' blocks
+// deep, which saves the rolls of the files of the other side when they are
+// hashed to the depth of the manifest. Symbolic links are not listed.
+// The Analyzer cannot be used afterwards.
+func (a *Analyzer) Manifest(root string, depth int64) (*Manifest, error) {
+	err := a.VisitSource(root)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Root: root, Hash: a.Hash}
+	for key, v := range a.entries.m {
+		if v.sourceID == nil {
+			continue
+		}
+	files:
+		for _, fid := range append([]*fileID{v.sourceID}, v.sourceDups...) {
+			k := key
+			var file *os.File
+			for k.pos < depth && !k.complete() {
+				err := a.rollingChecksum(a.sourceRoot, fid, &k, &file)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					logf(a.Log, "%v", err)
+					closeFile(file)
+					continue files
+				}
+			}
+			closeFile(file)
+			k = k.normalize()
+			m.Files = append(m.Files, ManifestFile{
+				Path:        filepath.ToSlash(fid.path()),
+				Size:        k.size,
+				Pos:         k.pos,
+				Hash:        hex.EncodeToString([]byte(k.hash)),
+				Fingerprint: a.fingerprint(match{key: k, targetID: fid}, a.sourceRoot),
+			})
+		}
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	return m, nil
+}
+
+// A manifestIndex holds the files of a manifest by partial hash. The files of
+// the manifest cannot be read, so the conflicts are resolved by hashing the
+// local files to the depths the manifest records for their size.
+type manifestIndex struct {
+	files map[partialHash][]*fileID
+	// The depths of the partial hashes by size, in increasing order.
+	depths map[int64][]int64
+	// The fingerprints by native path.
+	fingerprints map[string]string
+}
+
+func newManifestIndex(m *Manifest) (*manifestIndex, error) {
+	ix := &manifestIndex{
+		files:        make(map[partialHash][]*fileID),
+		depths:       make(map[int64][]int64),
+		fingerprints: make(map[string]string),
+	}
+	paths := newPathTable()
+	for _, f := range m.Files {
+		hash, err := hex.DecodeString(f.Hash)
+		if err != nil || f.Size <= 0 || f.Pos < 0 {
+			return nil, fmt.Errorf("invalid manifest entry '%v'", f.Path)
+		}
+		path := filepath.Clean(filepath.FromSlash(f.Path))
+		key := partialHash{size: f.Size, pos: f.Pos, hash: string(hash)}.normalize()
+		fid := paths.id(path)
+		ix.files[key] = append(ix.files[key], &fid)
+		ix.fingerprints[path] = f.Fingerprint
+		depths := ix.depths[key.size]
+		i := sort.Search(len(depths), func(i int) bool { return depths[i] >= key.pos })
+		if i == len(depths) || depths[i] != key.pos {
+			depths = append(depths, 0)
+			copy(depths[i+1:], depths[i:])
+			depths[i] = key.pos
+			ix.depths[key.size] = depths
+		}
+	}
+	return ix, nil
+}
+
+// localFiles holds the files of the local side of a manifest analysis, by
+// partial hash. A file is stored under its partial hash at every depth of the
+// manifest for its size.
+type localFiles struct {
+	mu sync.Mutex
+	m  map[partialHash][]*fileID
+}
+
+func newLocalFiles() *localFiles {
+	return &localFiles{m: make(map[partialHash][]*fileID)}
+}
+
+// hashLocal hashes the local file 'fid' of 'root' to the depths of 'ix' for
+// its size and stores it in 'local'. Files of sizes absent from the manifest
+// are not read.
+func (a *Analyzer) hashLocal(ix *manifestIndex, local *localFiles, root string, fid *fileID, size int64) {
+	depths := ix.depths[size]
+	if len(depths) == 0 {
+		return
+	}
+	var file *os.File
+	defer func() { closeFile(file) }()
+	var keys []partialHash
+	k := partialHash{size: size}
+	for _, depth := range depths {
+		for k.pos < depth && !k.complete() {
+			err := a.rollingChecksum(root, fid, &k, &file)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				logf(a.Log, "%v", err)
+				return
+			}
+		}
+		key := k.normalize()
+		if len(keys) > 0 && keys[len(keys)-1] == key {
+			// Complete already.
+			break
+		}
+		keys = append(keys, key)
+	}
+	local.mu.Lock()
+	for _, key := range keys {
+		local.m[key] = append(local.m[key], fid)
+	}
+	local.mu.Unlock()
+}
+
+// manifestMatches pairs the local files with the manifest files of the same
+// partial hash. 'fromSource' tells whether the manifest describes SOURCE.
+// When several local files match an incomplete partial hash, the manifest file
+// cannot be read to tell which one is the match: they are all skipped.
+func (a *Analyzer) manifestMatches(ix *manifestIndex, local *localFiles, fromSource bool) []match {
+	var result []match
+	for key, files := range ix.files {
+		locals := local.m[key]
+		if len(locals) == 0 {
+			continue
+		}
+		v := fileMatch{sourceID: locals[0], sourceDups: locals[1:], targetID: files[0], targetDups: files[1:]}
+		if fromSource {
+			v = fileMatch{sourceID: files[0], sourceDups: files[1:], targetID: locals[0], targetDups: locals[1:]}
+		}
+		result = append(result, a.pairListed(key, v, locals)...)
+	}
+	return result
+}
+
+// pairListed returns the matches of 'v', the files of one side being listed in
+// a manifest or a checksum list, and 'locals' the files of the other side.
+func (a *Analyzer) pairListed(key partialHash, v fileMatch, locals []*fileID) []match {
+	switch {
+	case len(v.sourceDups) == 0 && len(v.targetDups) == 0:
+		return []match{{key: key, sourceID: v.sourceID, targetID: v.targetID}}
+	case !key.complete():
+		for _, fid := range locals {
+			logf(a.Log, "Ambiguous manifest match (%x) '%v'", key.hash, fid.path())
+		}
+	case a.Duplicates:
+		return a.pairDuplicates(key, v)
+	default:
+		for _, fid := range append([]*fileID{v.targetID}, v.targetDups...) {
+			logf(a.Log, "Target duplicate (%x) '%v'", key.hash, fid.path())
+		}
+	}
+	return nil
+}
+
+// VisitManifest uses the manifest 'm' as SOURCE, in place of VisitSource.
+// Analyze then hashes the TARGET files to the depths recorded in the manifest.
+// The Hash of the Analyzer must be that of the manifest. Verify is not
+// supported and symbolic links are not matched.
+func (a *Analyzer) VisitManifest(m *Manifest) error {
+	if a.Verify {
+		return errVerifyListed
+	}
+	newHash, err := a.manifestHash(m)
+	if err != nil {
+		return err
+	}
+	ix, err := newManifestIndex(m)
+	if err != nil {
+		return err
+	}
+	a.newHash = newHash
+	a.manifest = ix
+	return nil
+}
+
+// manifestHash returns the checksum algorithm of the Analyzer, which must be
+// that of 'm'.
+func (a *Analyzer) manifestHash(m *Manifest) (func() hash.Hash, error) {
+	if a.Hash == "" {
+		a.Hash = DefaultHash
+	}
+	if m.Hash != a.Hash {
+		return nil, fmt.Errorf("manifest uses hash '%v', not '%v'", m.Hash, a.Hash)
+	}
+	if a.Cache != nil && a.Cache.hash != a.Hash {
+		return nil, fmt.Errorf("cache uses hash '%v', not '%v'", a.Cache.hash, a.Hash)
+	}
+	return lookupHash(a.Hash)
+}
+
+// visitTargetManifest returns the matches of the files of 'root' against the
+// manifest SOURCE.
+func (a *Analyzer) visitTargetManifest(root string) ([]match, error) {
+	paths := newPathTable()
+	local := newLocalFiles()
+	err := a.walkTarget(root, nil, func(input string, info os.FileInfo) {
+		if isSymlink(info) {
+			return
+		}
+		fid, key := a.newFileEntry(paths, root, input, info)
+		a.hashLocal(a.manifest, local, root, &fid, key.size)
+	})
+	return a.manifestMatches(a.manifest, local, true), err
+}
+
+// AnalyzeManifest matches the files of the manifest 'm' as TARGET against
+// SOURCE and returns the resulting plan. The SOURCE files are hashed to the
+// depths recorded in the manifest. The plan is to be processed where the
+// folder of the manifest is: its Target is the root of the manifest. Verify,
+// Folders, Symlinks and RelocateLinks are not supported: they return an error.
+func (a *Analyzer) AnalyzeManifest(m *Manifest) (Plan, error) {
+	if a.manifest != nil {
+		return Plan{}, errTwoManifests
+	}
+	if a.sourceRoot == "" {
+		return Plan{}, errNoSource
+	}
+	if a.Verify {
+		return Plan{}, errVerifyListed
+	}
+	if a.Folders || a.Symlinks || a.RelocateLinks {
+		return Plan{}, errWalkOnly
+	}
+	_, err := a.manifestHash(m)
+	if err != nil {
+		return Plan{}, err
+	}
+	ix, err := newManifestIndex(m)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	local := newLocalFiles()
+	for key, v := range a.entries.m {
+		if v.sourceID == nil {
+			continue
+		}
+		for _, fid := range append([]*fileID{v.sourceID}, v.sourceDups...) {
+			// The SOURCE entries are left untouched for the other TARGETs.
+			c := cloneID(fid)
+			c.state, c.stale = nil, false
+			a.hashLocal(ix, local, a.sourceRoot, c, key.size)
+		}
+	}
+
+	p := a.plan(a.manifestMatches(ix, local, false), "")
+	for oldpath, mt := range p.Matches {
+		mt.Fingerprint = ix.fingerprints[oldpath]
+		p.Matches[oldpath] = mt
+	}
+	p.Target = m.Root
+	p.MinSize = a.MinSize
+	p.MaxSize = a.MaxSize
+	return p, nil
+}
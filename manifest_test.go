@@ -0,0 +1,141 @@
+package hsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// manifestTrees returns a SOURCE and a TARGET where 'b' and 'c' differ in
+// their second block only, and so do the TARGET files 'u1' and 'u2', one of
+// which is the unique SOURCE file of their size.
+func manifestTrees(t *testing.T) (source, target string) {
+	block := strings.Repeat("x", blocksize)
+	source = writeTree(t, map[string]string{
+		"a/x":  "some content",
+		"b":    block + "b",
+		"c":    block + "c",
+		"dup1": "dup!",
+		"dup2": "dup!",
+		"u":    block + "u1",
+	})
+	target = writeTree(t, map[string]string{
+		"x":  "some content",
+		"b2": block + "b",
+		"c2": block + "c",
+		"d":  "dup!",
+		"u1": block + "u1",
+		"u2": block + "u2",
+	})
+	return source, target
+}
+
+// manifest returns the manifest of 'root', written and read back.
+func manifest(t *testing.T, root string, depth int64) *Manifest {
+	a := NewAnalyzer()
+	a.Log = log.New(ioutil.Discard, "", 0)
+	m, err := a.Manifest(root, depth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("Got manifest %+v, want %+v", got, m)
+	}
+	return got
+}
+
+func TestManifest(t *testing.T) {
+	source, target := manifestTrees(t)
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+
+	all := map[string]string{"x": "a/x", "b2": "b", "c2": "c", "u1": "u"}
+	// At depth 1, 'u1' and 'u2' cannot be told apart from the manifest of 'u'.
+	// Their own manifest tells them apart.
+	for _, tt := range []struct {
+		depth int64
+		want  map[string]string
+	}{
+		{1, map[string]string{"x": "a/x", "b2": "b", "c2": "c"}},
+		{2, all},
+	} {
+		a := NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		if err := a.VisitManifest(manifest(t, source, tt.depth)); err != nil {
+			t.Fatal(err)
+		}
+		p, err := a.Analyze(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p.Renames, tt.want) {
+			t.Errorf("Manifest SOURCE at depth %v: got renames %v, want %v", tt.depth, p.Renames, tt.want)
+		}
+
+		a = NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		if err := a.VisitSource(source); err != nil {
+			t.Fatal(err)
+		}
+		p, err = a.AnalyzeManifest(manifest(t, target, tt.depth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p.Renames, all) {
+			t.Errorf("Manifest TARGET at depth %v: got renames %v, want %v", tt.depth, p.Renames, all)
+		}
+		if p.Target != target {
+			t.Errorf("Got target %q, want %q", p.Target, target)
+		}
+		for path, m := range p.Matches {
+			if m.Fingerprint == "" {
+				t.Errorf("No fingerprint for '%v'", path)
+			}
+		}
+	}
+}
+
+func TestManifestTargetOptions(t *testing.T) {
+	source, target := manifestTrees(t)
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+	m := manifest(t, target, 1)
+
+	for _, set := range []func(a *Analyzer){
+		func(a *Analyzer) { a.Folders = true },
+		func(a *Analyzer) { a.Symlinks = true },
+		func(a *Analyzer) { a.RelocateLinks = true },
+	} {
+		a := NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		set(a)
+		if err := a.VisitSource(source); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.AnalyzeManifest(m); err != errWalkOnly {
+			t.Errorf("Got error %v, want %v", err, errWalkOnly)
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, Plan{Hash: "md5", Renames: map[string]string{"a": "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(&buf); err != ErrNotManifest {
+		t.Errorf("Got error %v for a preview, want %v", err, ErrNotManifest)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A dirNode is an interned folder. Folders are stored as a tree so that the
+// files of a folder share its path, and the folders share their parents.
+type dirNode struct {
+	parent *dirNode
+	name   string
+}
+
+func (d *dirNode) path() string {
+	if d.parent == nil {
+		return d.name
+	}
+	return d.parent.path() + separator + d.name
+}
+
+type dirKey struct {
+	parent *dirNode
+	name   string
+}
+
+// pathTable interns the folders of the files of a walk.
+type pathTable struct {
+	mu       sync.Mutex
+	children map[dirKey]*dirNode
+	// The last folder interned: files are visited folder by folder.
+	lastPath string
+	last     *dirNode
+}
+
+func newPathTable() *pathTable {
+	return &pathTable{children: make(map[dirKey]*dirNode)}
+}
+
+// clone returns a copy of 's' that does not retain the memory of a longer
+// string it would be a substring of.
+func clone(s string) string {
+	return string([]byte(s))
+}
+
+// id returns the fileID of 'path'.
+func (t *pathTable) id(path string) fileID {
+	return fileID{dir: t.intern(filepath.Dir(path)), name: clone(filepath.Base(path))}
+}
+
+// intern returns the node of the folder 'dir', "." being the root.
+func (t *pathTable) intern(dir string) *dirNode {
+	if dir == "." {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if dir == t.lastPath {
+		return t.last
+	}
+	var node *dirNode
+	for _, name := range strings.Split(dir, separator) {
+		child, ok := t.children[dirKey{parent: node, name: name}]
+		if !ok {
+			child = &dirNode{parent: node, name: clone(name)}
+			t.children[dirKey{parent: node, name: child.name}] = child
+		}
+		node = child
+	}
+	t.lastPath, t.last = dir, node
+	return node
+}
@@ -0,0 +1,697 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReadPlan decodes a plan from its JSON representation as written by
+// WritePlan. Former formats are accepted as well: the legacy format, a flat
+// object mapping old paths to new paths, in which case the hash algorithm is
+// unknown and left empty; and version 1, where 'renames' is such an object.
+func ReadPlan(r io.Reader) (Plan, error) {
+	var raw json.RawMessage
+	err := json.NewDecoder(r).Decode(&raw)
+	if err != nil {
+		return Plan{}, err
+	}
+	return decodePlan(raw)
+}
+
+// ReadPlans decodes all the plans written one after the other by WritePlan,
+// e.g. one per TARGET.
+func ReadPlans(r io.Reader) ([]Plan, error) {
+	var plans []Plan
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return plans, nil
+		}
+		if err != nil {
+			return plans, err
+		}
+		p, err := decodePlan(raw)
+		if err != nil {
+			return plans, err
+		}
+		plans = append(plans, p)
+	}
+}
+
+func decodePlan(buf []byte) (Plan, error) {
+	var p Plan
+
+	// In the later formats, 'renames' is an object or an array and thus cannot
+	// be decoded as a string.
+	var legacy map[string]string
+	if json.Unmarshal(buf, &legacy) == nil {
+		p.Renames = legacy
+		return p, nil
+	}
+
+	err := json.Unmarshal(buf, &p)
+	if p.Renames == nil {
+		p.Renames = make(map[string]string)
+	}
+	return p, err
+}
+
+// planVersion is the version of the plan format. Version 1 has no 'version'
+// field and maps old paths to new paths in 'renames'. Version 2 lists the
+// renames as objects holding the details of their match.
+const planVersion = 2
+
+type planFile struct {
+	Version  int               `json:"version,omitempty"`
+	Target   string            `json:"target,omitempty"`
+	Hash     string            `json:"hash,omitempty"`
+	Renames  json.RawMessage   `json:"renames"`
+	Verified bool              `json:"verified,omitempty"`
+	Rejected map[string]string `json:"rejected,omitempty"`
+	MinSize  int64             `json:"minSize,omitempty"`
+	MaxSize  int64             `json:"maxSize,omitempty"`
+}
+
+// planEntry is a rename of the version 2 format. 'Confidence' is informative
+// and ignored when read. 'Files' holds the matches of the files of a folder
+// rename, by old path.
+type planEntry struct {
+	Old    string `json:"old"`
+	New    string `json:"new"`
+	Folder bool   `json:"folder,omitempty"`
+	Link   string `json:"link,omitempty"`
+	*Match
+	Confidence string           `json:"confidence,omitempty"`
+	Files      map[string]Match `json:"files,omitempty"`
+}
+
+// MarshalJSON encodes the plan in the current format. Renames are sorted by
+// old path.
+func (p Plan) MarshalJSON() ([]byte, error) {
+	olds := make([]string, 0, len(p.Renames))
+	for oldpath := range p.Renames {
+		olds = append(olds, oldpath)
+	}
+	sort.Strings(olds)
+
+	entries := make([]planEntry, 0, len(olds))
+	for _, oldpath := range olds {
+		e := planEntry{Old: oldpath, New: p.Renames[oldpath], Folder: p.Folders[oldpath], Link: p.Links[oldpath]}
+		if m, ok := p.Matches[oldpath]; ok {
+			e.Match = &m
+			e.Confidence = m.Confidence()
+		}
+		if e.Folder {
+			for path, m := range p.Matches {
+				if path != oldpath && inFolder(path, oldpath) {
+					if e.Files == nil {
+						e.Files = make(map[string]Match)
+					}
+					e.Files[path] = m
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+	renames, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(planFile{
+		Version:  planVersion,
+		Target:   p.Target,
+		Hash:     p.Hash,
+		Renames:  renames,
+		Verified: p.Verified,
+		Rejected: p.Rejected,
+		MinSize:  p.MinSize,
+		MaxSize:  p.MaxSize,
+	})
+}
+
+// UnmarshalJSON decodes the plan from the current format or version 1.
+func (p *Plan) UnmarshalJSON(buf []byte) error {
+	var f planFile
+	err := json.Unmarshal(buf, &f)
+	if err != nil {
+		return err
+	}
+	if f.Version > planVersion {
+		return fmt.Errorf("unsupported plan version %v", f.Version)
+	}
+
+	*p = Plan{
+		Target:   f.Target,
+		Hash:     f.Hash,
+		Renames:  make(map[string]string),
+		Matches:  make(map[string]Match),
+		Verified: f.Verified,
+		Rejected: f.Rejected,
+		MinSize:  f.MinSize,
+		MaxSize:  f.MaxSize,
+	}
+	if len(f.Renames) == 0 {
+		return nil
+	}
+	if f.Version < 2 {
+		return json.Unmarshal(f.Renames, &p.Renames)
+	}
+
+	var entries []planEntry
+	err = json.Unmarshal(f.Renames, &entries)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p.Renames[e.Old] = e.New
+		if e.Folder {
+			if p.Folders == nil {
+				p.Folders = make(map[string]bool)
+			}
+			p.Folders[e.Old] = true
+		}
+		if e.Link != "" {
+			if p.Links == nil {
+				p.Links = make(map[string]string)
+			}
+			p.Links[e.Old] = e.Link
+		}
+		if e.Match != nil {
+			p.Matches[e.Old] = *e.Match
+		}
+		for path, m := range e.Files {
+			p.Matches[path] = m
+		}
+	}
+	return nil
+}
+
+// WritePlan encodes the plan to w in a JSON format that can be edited by the
+// user and read back with ReadPlan. Every rename is listed with the details of
+// its match, if known, and their confidence, so that risky matches can be
+// spotted.
+func WritePlan(w io.Writer, p Plan) error {
+	// There should be no error.
+	buf, _ := json.MarshalIndent(p, "", "\t")
+	buf = append(buf, '\n')
+	_, err := w.Write(buf)
+	return err
+}
+
+// A Renamer processes the renames of a plan in TARGET.
+type Renamer struct {
+	// Root is the TARGET folder the paths of the plan are relative to.
+	Root string
+
+	// Clobber allows renames to overwrite existing files.
+	Clobber bool
+
+	// Log receives the processed renames and the errors. The standard logger
+	// is used if nil.
+	Log *log.Logger
+
+	// Journal, if not nil, records the plan before the renames start, then the
+	// renames and the created and removed folders so that they can be undone,
+	// or resumed if the run gets interrupted. Files overwritten because of
+	// Clobber cannot be restored.
+	Journal *Journal
+
+	// Prune removes the folders left empty by the renames once they are
+	// processed. Only the folders that contained renamed files, or such
+	// folders, are removed; folders that were empty already are left alone.
+	Prune bool
+
+	// emptied holds the folders that renamed files were moved out of.
+	emptied map[string]bool
+
+	// relinks maps the new paths of the symbolic links to rewrite to their new
+	// target.
+	relinks map[string]string
+}
+
+// Rename files as specified in the plan. Nothing is renamed if the plan is not
+// valid in Root, see Plan.ValidateIn. Entries whose old path does not exist
+// are skipped. So are the files that changed since the analysis, i.e. whose
+// size, fingerprint or partial hash differ from their match in the plan, and
+// the folders containing such files: they are reported to the log. Failing
+// renames are reported to the log as well and do not stop the processing.
+func (r *Renamer) Rename(p Plan) error {
+	if err := p.ValidateIn(r.Root); err != nil {
+		return err
+	}
+
+	var newHash func() hash.Hash
+	if p.Hash != "" {
+		var err error
+		newHash, err = lookupHash(p.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Folders are renamed first: files may be renamed into their old path.
+	fileOps, fileReverseOps := make(map[string]string), make(map[string]string)
+	folderOps, folderReverseOps := make(map[string]string), make(map[string]string)
+	var folders []string
+	// Symbolic links to rewrite without renaming them.
+	relinks := make(map[string]string)
+	for oldpath, newpath := range p.Renames {
+		if oldpath == newpath {
+			if target, ok := p.Links[oldpath]; ok {
+				relinks[oldpath] = target
+			}
+			continue
+		}
+		info, err := os.Lstat(r.path(oldpath))
+		if err != nil && os.IsNotExist(err) {
+			// Remove non-existing entries.
+			continue
+		}
+		if m, ok := p.Matches[oldpath]; ok && err == nil && r.changed(oldpath, info, m, newHash) {
+			logf(r.Log, "Content changed since the analysis, skip renaming: '%v' -> '%v'", oldpath, newpath)
+			continue
+		}
+		if p.Folders[oldpath] && err == nil && r.folderChanged(p, oldpath, newHash) {
+			logf(r.Log, "Folder content changed since the analysis, skip renaming: '%v' -> '%v'", oldpath, newpath)
+			continue
+		}
+		if target, ok := p.Links[oldpath]; ok {
+			if r.relinks == nil {
+				r.relinks = make(map[string]string)
+			}
+			r.relinks[newpath] = target
+		}
+		if p.Folders[oldpath] {
+			folderOps[oldpath] = newpath
+			folderReverseOps[newpath] = oldpath
+			folders = append(folders, oldpath)
+		} else {
+			fileOps[oldpath] = newpath
+			fileReverseOps[newpath] = oldpath
+		}
+	}
+
+	if r.Journal != nil {
+		root, err := filepath.Abs(r.Root)
+		if err != nil {
+			return err
+		}
+		// Record the plan before 'processRenames' consumes it.
+		renameOps := make(map[string]string)
+		for _, ops := range []map[string]string{folderOps, fileOps} {
+			for oldpath, newpath := range ops {
+				renameOps[oldpath] = newpath
+			}
+		}
+		for path := range relinks {
+			renameOps[path] = path
+		}
+		sort.Strings(folders)
+		links := make(map[string]string)
+		for oldpath, target := range p.Links {
+			if _, ok := renameOps[oldpath]; ok {
+				links[oldpath] = target
+			}
+		}
+		err = r.Journal.record(journalEntry{Root: root, Plan: renameOps, Folders: folders, Links: links})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := r.processRenames(folderOps, folderReverseOps, true)
+	if err != nil {
+		return err
+	}
+	err = r.processRenames(fileOps, fileReverseOps, false)
+	if err != nil {
+		return err
+	}
+	r.relinks = nil
+	for path, target := range relinks {
+		err = r.relink(path, target)
+		if err != nil {
+			return err
+		}
+	}
+	if r.Prune {
+		err = r.prune()
+		if err != nil {
+			return err
+		}
+	}
+	return r.record(journalEntry{Op: opDone})
+}
+
+// prune removes the folders in 'emptied' if they are empty, then their parents
+// likewise. Removals are recorded in the journal. Since os.Remove fails on
+// non-empty folders, files created meanwhile are safe.
+func (r *Renamer) prune() error {
+	dirs := make([]string, 0, len(r.emptied))
+	for dir := range r.emptied {
+		dirs = append(dirs, dir)
+	}
+	// Deepest folders first, so that parents are emptied before they are
+	// processed.
+	sort.Slice(dirs, func(i, j int) bool {
+		di, dj := strings.Count(dirs[i], separator), strings.Count(dirs[j], separator)
+		if di != dj {
+			return di > dj
+		}
+		return dirs[i] < dirs[j]
+	})
+
+	removed := make(map[string]bool)
+	for _, dir := range dirs {
+		for ; dir != "." && !removed[dir] && isEmptyDir(r.path(dir)); dir = filepath.Dir(dir) {
+			err := os.Remove(r.path(dir))
+			if err != nil {
+				logf(r.Log, "%v", err)
+				break
+			}
+			removed[dir] = true
+			logf(r.Log, "Remove folder '%v'", dir)
+			err = r.record(journalEntry{Op: opRmdir, Path: dir})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	r.emptied = nil
+	return nil
+}
+
+// changed reports whether the file at 'oldpath' does not fit its match anymore.
+// The fingerprint and the partial hash are only checked if the hash algorithm
+// of the plan is known. The fingerprint is a quick check on the first block
+// before the file is hashed up to the position of the match.
+func (r *Renamer) changed(oldpath string, info os.FileInfo, m Match, newHash func() hash.Hash) bool {
+	if m.Size != 0 && info.Size() != m.Size {
+		return true
+	}
+	if newHash == nil {
+		return false
+	}
+	if m.Fingerprint != "" {
+		fp, err := fingerprint(newHash(), r.path(oldpath))
+		if err != nil {
+			logf(r.Log, "%v", err)
+			return true
+		}
+		if fp != m.Fingerprint {
+			return true
+		}
+	}
+	if m.Hash == "" || m.Pos == 0 || m.Pos == 1 && m.Fingerprint != "" {
+		// Nothing more to check than the fingerprint.
+		return false
+	}
+	sum, err := partialSum(newHash(), r.path(oldpath), m.Pos)
+	if err != nil {
+		logf(r.Log, "%v", err)
+		return true
+	}
+	return sum != m.Hash
+}
+
+// folderChanged reports whether a file of the folder 'dir' that is matched in
+// the plan changed since the analysis or is gone.
+func (r *Renamer) folderChanged(p Plan, dir string, newHash func() hash.Hash) bool {
+	for path, m := range p.Matches {
+		if path == dir || !inFolder(path, dir) {
+			continue
+		}
+		info, err := os.Lstat(r.path(path))
+		if err != nil || r.changed(path, info, m, newHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyDir reports whether 'path' is a folder without entries.
+func isEmptyDir(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	return err == io.EOF
+}
+
+// markEmptied registers the folder of 'oldpath' for pruning.
+func (r *Renamer) markEmptied(oldpath string) {
+	if r.emptied == nil {
+		r.emptied = make(map[string]bool)
+	}
+	r.emptied[filepath.Dir(oldpath)] = true
+}
+
+func (r *Renamer) path(name string) string {
+	return filepath.Join(r.Root, name)
+}
+
+func (r *Renamer) record(e journalEntry) error {
+	if r.Journal == nil {
+		return nil
+	}
+	return r.Journal.record(e)
+}
+
+// The system calls used by renameNoClobber. They are variables so that tests
+// can disable them.
+var (
+	renameNoReplace = sysRenameNoReplace
+	linkFile        = os.Link
+	removeFile      = os.Remove
+)
+
+// renameNoClobber renames 'oldpath' to 'newpath' unless 'newpath' exists, in
+// which case the error satisfies os.IsExist. The check is atomic with
+// renameNoReplace. When it is not supported, we create a hard link to the new
+// path, which fails if it exists, then remove the old path. The rename is not
+// atomic anymore but still never overwrites. Last, for filesystems without hard
+// links, we check the existence before renaming, which is racy.
+func renameNoClobber(oldpath, newpath string) error {
+	err := renameNoReplace(oldpath, newpath)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+
+	err = linkFile(oldpath, newpath)
+	if err == nil {
+		err = removeFile(oldpath)
+		if err != nil {
+			// Leave the file as it was.
+			removeFile(newpath)
+		}
+		return err
+	}
+	if os.IsExist(err) {
+		return err
+	}
+
+	if _, err := os.Lstat(newpath); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// rename renames 'oldpath' to 'newpath' and records it in the journal. Unless
+// 'clobber' is true, existing files are not overwritten. Rename errors are
+// reported to the log. Journal errors are returned since the renames could not
+// be undone.
+func (r *Renamer) rename(oldpath, newpath string, clobber bool) error {
+	var err error
+	if clobber {
+		err = os.Rename(r.path(oldpath), r.path(newpath))
+	} else {
+		err = renameNoClobber(r.path(oldpath), r.path(newpath))
+	}
+	if os.IsExist(err) {
+		logf(r.Log, "Destination exists, skip renaming: '%v' -> '%v'", oldpath, newpath)
+		return nil
+	}
+	if err != nil {
+		logf(r.Log, "%v", err)
+		return nil
+	}
+	logf(r.Log, "Rename '%v' -> '%v'", oldpath, newpath)
+	if r.Prune {
+		r.markEmptied(oldpath)
+	}
+	err = r.record(journalEntry{Op: opRename, Old: oldpath, New: newpath})
+	if err != nil {
+		return err
+	}
+	if target, ok := r.relinks[newpath]; ok {
+		return r.relink(newpath, target)
+	}
+	return nil
+}
+
+// relink sets the target of the symbolic link 'path' to 'target' and records
+// it in the journal, together with the temporary link it uses. Link errors are
+// reported to the log.
+func (r *Renamer) relink(path, target string) error {
+	old, err := os.Readlink(r.path(path))
+	if err != nil {
+		logf(r.Log, "%v", err)
+		return nil
+	}
+	if old == target {
+		return nil
+	}
+	var journalErr error
+	err = replaceLink(r.Root, path, target, func(tmp string) error {
+		journalErr = r.record(journalEntry{Op: opTmpLink, Path: tmp, Old: path})
+		return journalErr
+	})
+	if journalErr != nil {
+		return journalErr
+	}
+	if err != nil {
+		logf(r.Log, "%v", err)
+		return nil
+	}
+	logf(r.Log, "Relink '%v': '%v' -> '%v'", path, old, target)
+	return r.record(journalEntry{Op: opRelink, Path: path, Old: old, New: target})
+}
+
+// mkdirAll is like os.MkdirAll for 'dir' in Root. The created folders are
+// recorded in the journal. Journal errors are returned separately from folder
+// creation errors.
+func (r *Renamer) mkdirAll(dir string) (journalErr, err error) {
+	var missing []string
+	for d := dir; d != "." && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Lstat(r.path(d)); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+
+	err = os.MkdirAll(r.path(dir), 0777)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		journalErr = r.record(journalEntry{Op: opMkdir, Path: missing[i]})
+		if journalErr != nil {
+			return journalErr, nil
+		}
+	}
+	return nil, nil
+}
+
+// tempFile creates an empty file in Root to hold 'oldpath' while a cycle is
+// broken, or an empty folder if 'folder' is true. Its name is recorded in the
+// journal before the file is created so that it cannot be left behind
+// unnoticed.
+func (r *Renamer) tempFile(oldpath string, folder bool) (string, error) {
+	for i := 0; i < 10000; i++ {
+		tmp := application + strconv.FormatUint(uint64(rand.Uint32()), 10)
+		err := r.record(journalEntry{Op: opTmp, Path: tmp, Old: oldpath})
+		if err != nil {
+			return "", err
+		}
+		if folder {
+			err = os.Mkdir(r.path(tmp), 0700)
+		} else {
+			var f *os.File
+			f, err = os.OpenFile(r.path(tmp), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+			if err == nil {
+				err = f.Close()
+			}
+		}
+		if os.IsExist(err) {
+			continue
+		}
+		return tmp, err
+	}
+	return "", errTempFile
+}
+
+// Chains and cycles may occur. See the implementation details. 'folders' is
+// true if the renames are folder renames.
+func (r *Renamer) processRenames(renameOps, reverseOps map[string]string, folders bool) error {
+	for oldpath, newpath := range renameOps {
+		if oldpath == newpath {
+			continue
+		}
+
+		cycleMarker := oldpath
+
+		// Go forward to the end of the chain or the cycle.
+		for newpath != cycleMarker {
+			_, ok := renameOps[newpath]
+			if !ok {
+				break
+			}
+			oldpath = newpath
+			newpath = renameOps[newpath]
+		}
+
+		// If cycle, break it down to a chain.
+		if cycleMarker == newpath {
+			tmp, err := r.tempFile(oldpath, folders)
+			if err != nil {
+				return err
+			}
+
+			// The temporary file is ours and meant to be replaced.
+			err = r.rename(oldpath, tmp, true)
+			if err != nil {
+				return err
+			}
+
+			// Plug temp file to the other end of the chain.
+			reverseOps[cycleMarker] = tmp
+
+			// During one loop over 'renameOps', we may process several operations in
+			// case of chains and cycles. Remove rename operation so that no other
+			// loop over 'renameOps' processes it again.
+			delete(renameOps, oldpath)
+			// Go backward.
+			newpath = oldpath
+			oldpath = reverseOps[oldpath]
+		}
+
+		// Process the chain of renames. Renaming can still fail, in which case we
+		// output the error and go on with the chain.
+		for oldpath != "" {
+			journalErr, err := r.mkdirAll(filepath.Dir(newpath))
+			if journalErr != nil {
+				return journalErr
+			}
+			if err != nil {
+				logf(r.Log, "%v", err)
+			} else {
+				err = r.rename(oldpath, newpath, r.Clobber)
+				if err != nil {
+					return err
+				}
+			}
+
+			delete(renameOps, oldpath)
+			newpath = oldpath
+			oldpath = reverseOps[oldpath]
+		}
+	}
+	return nil
+}
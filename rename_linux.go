@@ -0,0 +1,14 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+//go:build linux
+
+package hsync
+
+import "golang.org/x/sys/unix"
+
+// sysRenameNoReplace renames atomically unless 'newpath' exists. It requires
+// Linux 3.15 and a filesystem that supports RENAME_NOREPLACE.
+func sysRenameNoReplace(oldpath, newpath string) error {
+	return unix.Renameat2(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath, unix.RENAME_NOREPLACE)
+}
@@ -0,0 +1,11 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+//go:build !linux
+
+package hsync
+
+// sysRenameNoReplace is not supported on this platform.
+func sysRenameNoReplace(oldpath, newpath string) error {
+	return errNotSupported
+}
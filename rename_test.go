@@ -0,0 +1,283 @@
+package hsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// copyTree copies the regular files and folders of 'src' into 'dst'.
+func copyTree(t *testing.T, src, dst string) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0777)
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), buf, 0666)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Each file of testdata/ren contains its expected position in the chain or
+// cycle.
+func TestRename(t *testing.T) {
+	root, err := ioutil.TempDir("", application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	copyTree(t, "testdata/ren", root)
+
+	f, err := os.Open("testdata/ren.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ReadPlan(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := Renamer{Root: root, Log: log.New(ioutil.Discard, "", 0)}
+	if err := r.Rename(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"chain2":    "1",
+		"chain3":    "2",
+		"chain4":    "3",
+		"cycle1":    "3",
+		"cycle2":    "1",
+		"cycle3":    "2",
+		"existing":  "existing",
+		"noclobber": "noclobber",
+		"sub2/file": "",
+		"identical": "",
+	}
+	for path, content := range want {
+		buf, err := ioutil.ReadFile(filepath.Join(root, path))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(buf) != content {
+			t.Errorf("'%v' contains %q, want %q", path, buf, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "chain1")); !os.IsNotExist(err) {
+		t.Errorf("'chain1' should have been renamed")
+	}
+}
+
+func TestRenameNoClobber(t *testing.T) {
+	defer func(r func(string, string) error, l func(string, string) error) {
+		renameNoReplace, linkFile = r, l
+	}(renameNoReplace, linkFile)
+
+	unsupported := func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "test", Old: oldpath, New: newpath, Err: errNotSupported}
+	}
+	for _, strategy := range []string{"renameat2", "link", "stat"} {
+		renameNoReplace, linkFile = sysRenameNoReplace, os.Link
+		switch strategy {
+		case "link":
+			renameNoReplace = unsupported
+		case "stat":
+			renameNoReplace, linkFile = unsupported, unsupported
+		}
+
+		root, err := ioutil.TempDir("", application)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		write := func(name, content string) string {
+			path := filepath.Join(root, name)
+			if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+				t.Fatal(err)
+			}
+			return path
+		}
+		read := func(path string) string {
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return ""
+			}
+			return string(buf)
+		}
+
+		oldpath, existing := write("old", "old"), write("existing", "existing")
+		err = renameNoClobber(oldpath, existing)
+		if !os.IsExist(err) {
+			t.Errorf("%v: got error %v, want existing destination", strategy, err)
+		}
+		if read(oldpath) != "old" || read(existing) != "existing" {
+			t.Errorf("%v: files were modified", strategy)
+		}
+
+		newpath := filepath.Join(root, "new")
+		err = renameNoClobber(oldpath, newpath)
+		if err != nil {
+			t.Errorf("%v: %v", strategy, err)
+		}
+		if _, err := os.Lstat(oldpath); !os.IsNotExist(err) {
+			t.Errorf("%v: old path still exists", strategy)
+		}
+		if read(newpath) != "old" {
+			t.Errorf("%v: got content %q, want %q", strategy, read(newpath), "old")
+		}
+	}
+}
+
+func TestPlanFormats(t *testing.T) {
+	want := Plan{
+		Target:   "target",
+		Hash:     "md5",
+		Renames:  map[string]string{"a": "b", "c": "d"},
+		Matches:  map[string]Match{"a": {Size: 10, Pos: 1, Hash: "00ff"}},
+		Verified: true,
+		Rejected: map[string]string{"e": "f"},
+		MinSize:  2,
+	}
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got plan %+v, want %+v", got, want)
+	}
+
+	for _, input := range []string{
+		`{"a": "b", "c": "d"}`,
+		`{"target": "target", "hash": "md5", "renames": {"a": "b", "c": "d"}}`,
+		`{"version": 2, "target": "target", "hash": "md5", "renames": [{"old": "a", "new": "b"}, {"old": "c", "new": "d", "size": 3, "pos": 0, "confidence": "size"}]}`,
+	} {
+		p, err := ReadPlan(strings.NewReader(input))
+		if err != nil {
+			t.Errorf("%v: %v", input, err)
+			continue
+		}
+		if want := map[string]string{"a": "b", "c": "d"}; !reflect.DeepEqual(p.Renames, want) {
+			t.Errorf("%v: got renames %v, want %v", input, p.Renames, want)
+		}
+	}
+
+	if _, err := ReadPlan(strings.NewReader(`{"version": 99, "renames": []}`)); err == nil {
+		t.Errorf("Unsupported version: want an error")
+	}
+}
+
+func TestMatchConfidence(t *testing.T) {
+	for _, tt := range []struct {
+		m    Match
+		want string
+	}{
+		{Match{Size: 10}, "size"},
+		{Match{Size: 3 * blocksize, Pos: 2}, "partial"},
+		{Match{Size: 3 * blocksize, Pos: 3}, "full"},
+		{Match{Size: 10, Pos: 1}, "full"},
+		{Match{Size: 10, Verified: true}, "verified"},
+	} {
+		if got := tt.m.Confidence(); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.m, got, tt.want)
+		}
+	}
+}
+
+// Files that changed between the analysis and the renames are skipped.
+func TestRenameChanged(t *testing.T) {
+	source := writeTree(t, map[string]string{"a": "aaaa", "b": "bbbbbb", "c": "cccccccc"})
+	defer os.RemoveAll(source)
+	target := writeTree(t, map[string]string{"a1": "aaaa", "b1": "bbbbbb", "c1": "cccccccc"})
+	defer os.RemoveAll(target)
+
+	discard := log.New(ioutil.Discard, "", 0)
+	a := NewAnalyzer()
+	a.Log = discard
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Analyze(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for oldpath, m := range p.Matches {
+		if m.Fingerprint == "" {
+			t.Errorf("'%v' has no fingerprint", oldpath)
+		}
+	}
+
+	// Same size, different content.
+	if err := ioutil.WriteFile(filepath.Join(target, "b1"), []byte("BBBBBB"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// Different size.
+	if err := ioutil.WriteFile(filepath.Join(target, "c1"), []byte("ccc"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	r := Renamer{Root: target, Log: discard}
+	if err := r.Rename(p); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := readTree(t, target)
+	want := map[string]string{"a": "aaaa", "b1": "BBBBBB", "c1": "ccc"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Got files %v, want %v", files, want)
+	}
+}
+
+// Changes past the first block are detected with the partial hash of the match.
+func TestRenameChangedPastFingerprint(t *testing.T) {
+	block := strings.Repeat("x", blocksize)
+	source := writeTree(t, map[string]string{"d": block + "d", "e": block + "e"})
+	defer os.RemoveAll(source)
+	target := writeTree(t, map[string]string{"d1": block + "d", "e1": block + "e"})
+	defer os.RemoveAll(target)
+
+	discard := log.New(ioutil.Discard, "", 0)
+	a := NewAnalyzer()
+	a.Log = discard
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Analyze(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := p.Matches["d1"]; m.Pos != 2 {
+		t.Fatalf("Got match %+v for 'd1', want pos 2", m)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(target, "d1"), []byte(block+"D"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r := Renamer{Root: target, Log: discard}
+	if err := r.Rename(p); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := readTree(t, target)
+	want := map[string]string{"d1": block + "D", "e": block + "e"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Got files %v, want %v", files, want)
+	}
+}
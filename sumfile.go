@@ -0,0 +1,234 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotChecksums is returned by ReadChecksums when the content is not a
+// checksum list.
+var ErrNotChecksums = errors.New("not a checksum list")
+
+// The checksum algorithms by tag of the BSD format. Other tags are lowercased.
+var sumTags = map[string]string{
+	"BLAKE2b-256": "blake2b",
+}
+
+// The checksum algorithms guessed from the length of the digests in hexadecimal.
+var sumLengths = map[int]string{
+	32: "md5",
+	40: "sha1",
+	64: "sha256",
+}
+
+// Checksums is a list of files with the digest of their whole content, as
+// written by md5sum, sha256sum and the like, or by their BSD counterparts.
+type Checksums struct {
+	// Hash is the checksum algorithm of the digests, as named by the tags of
+	// the BSD format or guessed from the length of the digests.
+	Hash string
+
+	Files []ChecksumFile
+}
+
+// A ChecksumFile is a file of a checksum list.
+type ChecksumFile struct {
+	// Path is the path of the file as listed, cleaned.
+	Path string
+
+	// Digest is the digest of the file, in lowercase hexadecimal.
+	Digest string
+}
+
+// ReadChecksums decodes a checksum list in the GNU format, one 'DIGEST  PATH'
+// per line, or in the BSD format, one 'TAG (PATH) = DIGEST' per line. Lines
+// starting with a backslash have their path escaped, as done by the GNU tools.
+// Blank lines and lines starting with '#' are ignored. It returns
+// ErrNotChecksums if the first line is not a checksum.
+func ReadChecksums(r io.Reader) (*Checksums, error) {
+	c := &Checksums{}
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		path, digest, hash, ok := parseChecksum(line)
+		if !ok {
+			if len(c.Files) == 0 {
+				return nil, ErrNotChecksums
+			}
+			return nil, fmt.Errorf("line %v: invalid checksum", n)
+		}
+		if c.Hash != "" && hash != c.Hash {
+			return nil, fmt.Errorf("line %v: checksum list mixes '%v' and '%v'", n, c.Hash, hash)
+		}
+		c.Hash = hash
+		c.Files = append(c.Files, ChecksumFile{Path: filepath.Clean(path), Digest: digest})
+		if err == io.EOF {
+			break
+		}
+	}
+	return c, nil
+}
+
+// parseChecksum returns the path, the digest and the checksum algorithm of
+// the line of a checksum list.
+func parseChecksum(line string) (path, digest, hash string, ok bool) {
+	escaped := strings.HasPrefix(line, `\`)
+	if escaped {
+		line = line[1:]
+	}
+	// GNU format: the digest, then a space and ' ' or '*' for binary mode.
+	if i := strings.IndexByte(line, ' '); i > 0 && i+2 <= len(line) && (line[i+1] == ' ' || line[i+1] == '*') && isDigest(line[:i]) {
+		path, digest = line[i+2:], strings.ToLower(line[:i])
+		hash = sumLengths[len(digest)]
+	} else {
+		// BSD format.
+		i := strings.Index(line, " (")
+		j := strings.LastIndex(line, ") = ")
+		if i <= 0 || j < i || !isDigest(line[j+4:]) {
+			return "", "", "", false
+		}
+		tag := line[:i]
+		path, digest = line[i+2:j], strings.ToLower(line[j+4:])
+		hash = sumTags[tag]
+		if hash == "" {
+			hash = strings.ToLower(tag)
+		}
+	}
+	if path == "" {
+		return "", "", "", false
+	}
+	if escaped {
+		path = unescapeChecksumPath(path)
+	}
+	return path, digest, hash, true
+}
+
+func isDigest(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && s != ""
+}
+
+// unescapeChecksumPath reverts the escaping of backslashes and line breaks in
+// the paths of the GNU tools.
+func unescapeChecksumPath(path string) string {
+	buf := make([]byte, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] != '\\' || i+1 == len(path) {
+			buf = append(buf, path[i])
+			continue
+		}
+		i++
+		switch path[i] {
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		default:
+			buf = append(buf, path[i])
+		}
+	}
+	return string(buf)
+}
+
+// VisitChecksums uses the checksum list 'c' as SOURCE, in place of
+// VisitSource: the listed paths are relative to SOURCE. The Hash of the
+// Analyzer is not taken from the list: it must be set to the algorithm of the
+// list, usually c.Hash, beforehand. Digests of another length are an error.
+// Since the list holds the digests of the whole content, Analyze reads the
+// TARGET files completely, unless they are in the cache, and matches them by
+// digest. Files listed outside SOURCE are skipped. Verify is not supported and
+// symbolic links are not matched.
+func (a *Analyzer) VisitChecksums(c *Checksums) error {
+	if a.Verify {
+		return errVerifyListed
+	}
+	if a.Hash == "" {
+		a.Hash = DefaultHash
+	}
+	newHash, err := lookupHash(a.Hash)
+	if err != nil {
+		return err
+	}
+	if a.Cache != nil && a.Cache.hash != a.Hash {
+		return fmt.Errorf("cache uses hash '%v', not '%v'", a.Cache.hash, a.Hash)
+	}
+
+	size := newHash().Size()
+	sums := make(map[string][]*fileID)
+	paths := newPathTable()
+	for _, f := range c.Files {
+		digest, _ := hex.DecodeString(f.Digest)
+		if len(digest) != size {
+			return fmt.Errorf("digest of '%v' does not match hash '%v'", f.Path, a.Hash)
+		}
+		if filepath.IsAbs(f.Path) || f.Path == ".." || strings.HasPrefix(f.Path, ".."+separator) {
+			logf(a.Log, "Checksum outside SOURCE, skip '%v'", f.Path)
+			continue
+		}
+		fid := paths.id(f.Path)
+		sums[string(digest)] = append(sums[string(digest)], &fid)
+	}
+	a.newHash = newHash
+	a.sums = sums
+	return nil
+}
+
+// visitTargetSums returns the matches of the files of 'root' against the
+// checksum list SOURCE.
+func (a *Analyzer) visitTargetSums(root string) ([]match, error) {
+	paths := newPathTable()
+	local := newLocalFiles()
+	err := a.walkTarget(root, nil, func(input string, info os.FileInfo) {
+		if isSymlink(info) {
+			return
+		}
+		fid, key := a.newFileEntry(paths, root, input, info)
+		var file *os.File
+		defer func() { closeFile(file) }()
+		for !key.complete() {
+			err := a.rollingChecksum(root, &fid, &key, &file)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				logf(a.Log, "%v", err)
+				return
+			}
+		}
+		if _, ok := a.sums[key.hash]; !ok {
+			return
+		}
+		local.mu.Lock()
+		key = key.normalize()
+		local.m[key] = append(local.m[key], &fid)
+		local.mu.Unlock()
+	})
+
+	var result []match
+	for key, locals := range local.m {
+		sources := a.sums[key.hash]
+		v := fileMatch{sourceID: sources[0], sourceDups: sources[1:], targetID: locals[0], targetDups: locals[1:]}
+		result = append(result, a.pairListed(key, v, locals)...)
+	}
+	return result, err
+}
@@ -0,0 +1,110 @@
+package hsync
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadChecksums(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		want  *Checksums
+		err   error
+	}{
+		{
+			input: "d41d8cd98f00b204e9800998ecf8427e  ./a b\n" +
+				"# comment\n\n" +
+				"D41D8CD98F00B204E9800998ECF8427E *sub/c\r\n" +
+				`\d41d8cd98f00b204e9800998ecf8427e  back\\slash\nline`,
+			want: &Checksums{Hash: "md5", Files: []ChecksumFile{
+				{"a b", "d41d8cd98f00b204e9800998ecf8427e"},
+				{"sub/c", "d41d8cd98f00b204e9800998ecf8427e"},
+				{"back\\slash\nline", "d41d8cd98f00b204e9800998ecf8427e"},
+			}},
+		},
+		{
+			input: "SHA1 (x (1).txt) = da39a3ee5e6b4b0d3255bfef95601890afd80709\n",
+			want: &Checksums{Hash: "sha1", Files: []ChecksumFile{
+				{"x (1).txt", "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+			}},
+		},
+		{
+			input: "{\n\t\"version\": 2\n}\n",
+			err:   ErrNotChecksums,
+		},
+	} {
+		got, err := ReadChecksums(strings.NewReader(tt.input))
+		if err != tt.err {
+			t.Errorf("Got error %v, want %v", err, tt.err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Got %+v, want %+v", got, tt.want)
+		}
+	}
+
+	mixed := "d41d8cd98f00b204e9800998ecf8427e  a\nda39a3ee5e6b4b0d3255bfef95601890afd80709  b\n"
+	if _, err := ReadChecksums(strings.NewReader(mixed)); err == nil {
+		t.Error("Mixed algorithms: got no error")
+	}
+}
+
+func TestChecksumSource(t *testing.T) {
+	sum := func(content string) string {
+		s := md5.Sum([]byte(content))
+		return hex.EncodeToString(s[:])
+	}
+	big := strings.Repeat("x", 3*blocksize) + "big"
+	list := sum("aaaa") + "  a\n" +
+		sum(big) + "  sub/big\n" +
+		sum("dup!") + "  dup1\n" +
+		sum("dup!") + "  dup2\n" +
+		sum("gone") + "  gone\n" +
+		sum("bbbb") + "  ../outside\n"
+	target := writeTree(t, map[string]string{
+		"x":    "aaaa",
+		"y":    "bbbb",
+		"z":    big,
+		"d":    "dup!",
+		"same": strings.Repeat("x", 3*blocksize) + "bag",
+	})
+	defer os.RemoveAll(target)
+
+	c, err := ReadChecksums(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, duplicates := range []bool{false, true} {
+		a := NewAnalyzer()
+		a.Log = log.New(ioutil.Discard, "", 0)
+		a.Duplicates = duplicates
+		if err := a.VisitChecksums(c); err != nil {
+			t.Fatal(err)
+		}
+		p, err := a.Analyze(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"x": "a", "z": "sub/big"}
+		if duplicates {
+			want["d"] = "dup1"
+		}
+		if !reflect.DeepEqual(p.Renames, want) {
+			t.Errorf("Duplicates=%v: got renames %v, want %v", duplicates, p.Renames, want)
+		}
+		if m := p.Matches["z"]; m.Confidence() != "full" || m.Size != int64(len(big)) {
+			t.Errorf("Got match %+v for 'z'", m)
+		}
+	}
+
+	a := NewAnalyzer()
+	a.Hash = "sha1"
+	if err := a.VisitChecksums(c); err == nil {
+		t.Error("Digest length mismatch: got no error")
+	}
+}
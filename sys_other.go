@@ -0,0 +1,13 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+//go:build !unix
+
+package hsync
+
+import "os"
+
+// fileIdentity is not supported on this platform.
+func fileIdentity(info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
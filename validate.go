@@ -0,0 +1,227 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A PlanProblem is an invalid entry of a plan.
+type PlanProblem struct {
+	Old, New string
+	Reason   string
+}
+
+func (pb PlanProblem) String() string {
+	return fmt.Sprintf("%v: '%v' -> '%v'", pb.Reason, pb.Old, pb.New)
+}
+
+// A PlanError lists all the problems found in a plan.
+type PlanError struct {
+	Problems []PlanProblem
+}
+
+func (e *PlanError) Error() string {
+	lines := make([]string, 0, len(e.Problems)+1)
+	lines = append(lines, fmt.Sprintf("invalid plan, %v problem(s):", len(e.Problems)))
+	for _, pb := range e.Problems {
+		lines = append(lines, pb.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkPath returns why 'path' is not a valid path relative to TARGET, or an
+// empty string.
+func checkPath(path string) string {
+	switch {
+	case path == "":
+		return "empty path"
+	case strings.ContainsRune(path, 0):
+		return "invalid character in path"
+	case filepath.IsAbs(path) || filepath.VolumeName(path) != "" || strings.HasPrefix(path, separator):
+		return "absolute path"
+	}
+	clean := filepath.Clean(path)
+	switch {
+	case clean == ".":
+		return "path is TARGET itself"
+	case clean == ".." || strings.HasPrefix(clean, ".."+separator):
+		return "path escapes TARGET"
+	}
+	return ""
+}
+
+// Validate checks that the plan can be processed safely. It returns a
+// *PlanError listing every invalid entry:
+// - Paths must be relative to TARGET and stay inside it.
+// - Two entries cannot refer to the same file.
+// - Two files cannot be renamed to the same path.
+// - A new path cannot be a folder of another new path.
+// - A renamed folder cannot contain other entries.
+// - Symbolic links to rewrite must be renamed, to a non-empty target.
+// Paths are compared once cleaned, so that e.g. 'a' and './a' are the same.
+func (p Plan) Validate() error {
+	var problems []PlanProblem
+	add := func(oldpath, reason string, v ...interface{}) {
+		problems = append(problems, PlanProblem{Old: oldpath, New: p.Renames[oldpath], Reason: fmt.Sprintf(reason, v...)})
+	}
+
+	olds := make([]string, 0, len(p.Renames))
+	for oldpath := range p.Renames {
+		olds = append(olds, oldpath)
+	}
+	sort.Strings(olds)
+
+	// Cleaned old path to old path.
+	sources := make(map[string]string)
+	// Cleaned new path to old paths.
+	dests := make(map[string][]string)
+	for _, oldpath := range olds {
+		newpath := p.Renames[oldpath]
+		if reason := checkPath(oldpath); reason != "" {
+			add(oldpath, "%v", reason)
+			continue
+		}
+		if reason := checkPath(newpath); reason != "" {
+			add(oldpath, "%v", reason)
+			continue
+		}
+
+		cleanOld, cleanNew := filepath.Clean(oldpath), filepath.Clean(newpath)
+		if other, ok := sources[cleanOld]; ok {
+			add(oldpath, "same file as entry '%v'", other)
+			continue
+		}
+		sources[cleanOld] = oldpath
+		// Files left in place claim their path as well.
+		dests[cleanNew] = append(dests[cleanNew], oldpath)
+	}
+
+	links := make([]string, 0, len(p.Links))
+	for oldpath := range p.Links {
+		links = append(links, oldpath)
+	}
+	sort.Strings(links)
+	for _, oldpath := range links {
+		target := p.Links[oldpath]
+		if _, ok := p.Renames[oldpath]; !ok {
+			problems = append(problems, PlanProblem{Old: oldpath, Reason: "link target without rename"})
+		} else if target == "" {
+			add(oldpath, "empty link target")
+		}
+	}
+
+	// Renamed folders, by cleaned old path.
+	folders := make(map[string]string)
+	for oldpath := range p.Folders {
+		if _, ok := p.Renames[oldpath]; ok && checkPath(oldpath) == "" {
+			folders[filepath.Clean(oldpath)] = oldpath
+		}
+	}
+	if len(folders) > 0 {
+		for _, oldpath := range olds {
+			if checkPath(oldpath) != "" {
+				continue
+			}
+			for _, dir := range parents(filepath.Clean(oldpath)) {
+				if folder, ok := folders[dir]; ok {
+					add(oldpath, "inside renamed folder '%v'", folder)
+					break
+				}
+			}
+		}
+	}
+
+	newpaths := make([]string, 0, len(dests))
+	for newpath := range dests {
+		newpaths = append(newpaths, newpath)
+	}
+	sort.Strings(newpaths)
+	for _, newpath := range newpaths {
+		if len(dests[newpath]) > 1 {
+			for _, oldpath := range dests[newpath] {
+				add(oldpath, "several files renamed to '%v'", newpath)
+			}
+		}
+		for dir := filepath.Dir(newpath); dir != "."; dir = filepath.Dir(dir) {
+			for _, oldpath := range dests[dir] {
+				add(oldpath, "new path is a folder of '%v'", newpath)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &PlanError{Problems: problems}
+	}
+	return nil
+}
+
+// ValidateIn is like Validate, and checks in addition that the paths do not
+// lead out of 'root', the TARGET folder, through a symbolic link.
+func (p Plan) ValidateIn(root string) error {
+	var problems []PlanProblem
+	if err := p.Validate(); err != nil {
+		perr, ok := err.(*PlanError)
+		if !ok {
+			return err
+		}
+		problems = perr.Problems
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	olds := make([]string, 0, len(p.Renames))
+	for oldpath := range p.Renames {
+		olds = append(olds, oldpath)
+	}
+	sort.Strings(olds)
+	for _, oldpath := range olds {
+		newpath := p.Renames[oldpath]
+		if checkPath(oldpath) != "" || checkPath(newpath) != "" {
+			continue
+		}
+		for _, path := range []string{oldpath, newpath} {
+			if escapes(realRoot, root, path) {
+				problems = append(problems, PlanProblem{Old: oldpath, New: newpath, Reason: fmt.Sprintf("'%v' escapes TARGET through a symbolic link", path)})
+				break
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &PlanError{Problems: problems}
+	}
+	return nil
+}
+
+// escapes reports whether the folder of 'path' in 'root' resolves out of
+// 'realRoot', the real path of 'root'. The folders that do not exist yet are
+// resolved from their closest existing parent. Other errors are left to the
+// rename.
+func escapes(realRoot, root, path string) bool {
+	dir := filepath.Dir(filepath.Clean(path))
+	for {
+		real, err := filepath.EvalSymlinks(filepath.Join(root, dir))
+		if err == nil {
+			return !within(realRoot, real)
+		}
+		if !os.IsNotExist(err) || dir == "." {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// within reports whether 'path' is 'root' or inside it. Both paths must be
+// clean.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+separator)
+}
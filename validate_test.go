@@ -0,0 +1,88 @@
+package hsync
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	p := Plan{Renames: map[string]string{
+		"ok":          "sub/ok",
+		"same":        "same",
+		"":            "empty",
+		"/abs":        "x",
+		"esc":         "../x",
+		"esc2":        "a/../../x",
+		"root":        ".",
+		"dup1":        "dest",
+		"dup2":        "./dest",
+		"./ok":        "ok2",
+		"dir":         "d",
+		"file":        "d/f",
+		"nul\x00name": "n",
+		"kept":        "kept",
+		"moved":       "kept",
+	}}
+	err := p.Validate()
+	perr, ok := err.(*PlanError)
+	if !ok {
+		t.Fatalf("Got error %v, want a *PlanError", err)
+	}
+	var got []string
+	for _, pb := range perr.Problems {
+		got = append(got, pb.String())
+	}
+	want := []string{
+		"empty path: '' -> 'empty'",
+		"absolute path: '/abs' -> 'x'",
+		"path escapes TARGET: 'esc' -> '../x'",
+		"path escapes TARGET: 'esc2' -> 'a/../../x'",
+		"invalid character in path: 'nul\x00name' -> 'n'",
+		"same file as entry './ok': 'ok' -> 'sub/ok'",
+		"path is TARGET itself: 'root' -> '.'",
+		"new path is a folder of 'd/f': 'dir' -> 'd'",
+		"several files renamed to 'dest': 'dup1' -> 'dest'",
+		"several files renamed to 'dest': 'dup2' -> './dest'",
+		"several files renamed to 'kept': 'kept' -> 'kept'",
+		"several files renamed to 'kept': 'moved' -> 'kept'",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got problems\n%q\nwant\n%q", got, want)
+	}
+
+	if err := (Plan{Renames: map[string]string{"a": "b", "b": "a", "c": "c", "d/e": "f/g"}}).Validate(); err != nil {
+		t.Errorf("Valid plan: %v", err)
+	}
+}
+
+func TestValidateIn(t *testing.T) {
+	target := writeTree(t, map[string]string{"sub/f": "f"})
+	defer os.RemoveAll(target)
+	outside := writeTree(t, map[string]string{"g": "g"})
+	defer os.RemoveAll(outside)
+	writeLinks(t, target, map[string]string{"out": outside, "in": "sub"})
+
+	p := Plan{Renames: map[string]string{
+		"sub/f":   "out/new/f",
+		"out/g":   "g",
+		"in/f":    "h",
+		"sub/new": "sub/x/y",
+	}}
+	err := p.ValidateIn(target)
+	perr, ok := err.(*PlanError)
+	if !ok {
+		t.Fatalf("Got error %v, want a *PlanError", err)
+	}
+	var got []string
+	for _, pb := range perr.Problems {
+		got = append(got, pb.String())
+	}
+	want := []string{
+		"'out/g' escapes TARGET through a symbolic link: 'out/g' -> 'g'",
+		"'out/new/f' escapes TARGET through a symbolic link: 'sub/f' -> 'out/new/f'",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got problems\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fingerprint returns the digest of the first block of the file at 'path', in
+// hexadecimal. Together with the size, it is used to detect quickly that a file
+// has changed since the analysis.
+func fingerprint(h hash.Hash, path string) (string, error) {
+	return partialSum(h, path, 1)
+}
+
+// partialSum returns the digest of the first 'pos' blocks of the file at
+// 'path', in hexadecimal, i.e. its partial hash at 'pos'.
+func partialSum(h hash.Hash, path string, pos int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, io.NewSectionReader(f, 0, pos*blocksize))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sameContent reports whether the files at 'path1' and 'path2' are identical.
+// Contrary to partial hashes, the whole content is compared byte by byte.
+func sameContent(path1, path2 string) (bool, error) {
+	f1, err := os.Open(path1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(path2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+
+	buf1 := make([]byte, 16*blocksize)
+	buf2 := make([]byte, 16*blocksize)
+	for {
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, err2 := io.ReadFull(f2, buf2)
+		if err1 != nil && err1 != io.EOF && err1 != io.ErrUnexpectedEOF {
+			return false, err1
+		}
+		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
+			return false, err2
+		}
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		if err1 != nil || err2 != nil {
+			// Both files must end at the same time.
+			return err1 != nil && err2 != nil, nil
+		}
+	}
+}
+
+// verify compares the content of all the matches that lead to a rename and
+// drops the ones that differ. It returns the remaining matches and the
+// rejected renames. Matches that cannot be read are rejected too.
+func (a *Analyzer) verify(matches []match, root string) ([]match, map[string]string) {
+	workers := a.Jobs
+	if workers < 1 {
+		workers = 1
+	}
+
+	accepted := make([]bool, len(matches))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				m := matches[i]
+				same, err := sameContent(filepath.Join(a.sourceRoot, m.sourceID.path()), filepath.Join(root, m.targetID.path()))
+				if err != nil {
+					logf(a.Log, "%v", err)
+				}
+				accepted[i] = same
+			}
+		}()
+	}
+	for i, m := range matches {
+		if m.targetID.path() == m.sourceID.path() {
+			// No rename, no need to verify.
+			accepted[i] = true
+			continue
+		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	var result []match
+	rejected := make(map[string]string)
+	for i, m := range matches {
+		if accepted[i] {
+			result = append(result, m)
+		} else {
+			logf(a.Log, "Rejected match '%v' -> '%v'", m.targetID.path(), m.sourceID.path())
+			rejected[m.targetID.path()] = m.sourceID.path()
+		}
+	}
+	return result, rejected
+}
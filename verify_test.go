@@ -0,0 +1,54 @@
+package hsync
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTree creates the files with the given content in a temporary folder.
+func writeTree(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// The only files of a given size match, even if their content differ.
+func TestVerify(t *testing.T) {
+	source := writeTree(t, map[string]string{"a": "aaaa", "x": "same content"})
+	defer os.RemoveAll(source)
+	target := writeTree(t, map[string]string{"b": "bbbb", "y": "same content"})
+	defer os.RemoveAll(target)
+
+	a := NewAnalyzer()
+	a.Log = log.New(ioutil.Discard, "", 0)
+	a.Verify = true
+	if err := a.VisitSource(source); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Analyze(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]string{"y": "x"}; !reflect.DeepEqual(p.Renames, want) {
+		t.Errorf("Got renames %v, want %v", p.Renames, want)
+	}
+	if want := map[string]string{"b": "a"}; !reflect.DeepEqual(p.Rejected, want) {
+		t.Errorf("Got rejected %v, want %v", p.Rejected, want)
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// resolveRoot returns the absolute path of 'root' with symbolic links
+// evaluated, so that a symlinked root is walked like any folder.
+func resolveRoot(root string) (string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", &os.PathError{Op: "walk", Path: root, Err: errNotDir}
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(root)
+}
+
+// A dirID identifies a folder: by its device and inode numbers where
+// supported, by its real path otherwise.
+type dirID struct {
+	dev, ino uint64
+	path     string
+}
+
+// identify returns the dirID of the folder 'path' described by 'info'.
+func identify(path string, info os.FileInfo) (dirID, error) {
+	if dev, ino, ok := fileIdentity(info); ok {
+		return dirID{dev: dev, ino: ino}, nil
+	}
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return dirID{}, err
+	}
+	return dirID{path: path}, nil
+}
+
+// dirMap stores the paths of folders by identity. A folder reached through
+// several paths, e.g. through symbolic links, is stored under all of them, so
+// that the content does not depend on the order of a parallel walk.
+type dirMap struct {
+	mu sync.Mutex
+	m  map[dirID][]string
+}
+
+func newDirMap() *dirMap {
+	return &dirMap{m: make(map[dirID][]string)}
+}
+
+func (d *dirMap) add(id dirID, path string) {
+	d.mu.Lock()
+	d.m[id] = append(d.m[id], path)
+	d.mu.Unlock()
+}
+
+// has reports whether 'path' is stored under 'id'.
+func (d *dirMap) has(id dirID, path string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.m[id] {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// A dirChain lists the folders from a folder being walked up to the root, so
+// that symbolic links leading back to one of them are not followed.
+type dirChain struct {
+	id     dirID
+	parent *dirChain
+}
+
+func (c *dirChain) contains(id dirID) bool {
+	for ; c != nil; c = c.parent {
+		if c.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// follow returns the description and the real path of the folder the
+// symbolic link 'path' in 'root' points to, or 'info', the description of the
+// link, if it does not point to a folder. The real path of followed links is
+// logged.
+func (a *Analyzer) follow(root, path string, info os.FileInfo) (os.FileInfo, string) {
+	target, err := os.Stat(filepath.Join(root, path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf(a.Log, "%v", err)
+		}
+		return info, ""
+	}
+	if !target.IsDir() {
+		return info, ""
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err == nil {
+		logf(a.Log, "Follow '%v' -> '%v'", path, real)
+	}
+	return target, real
+}
+
+// isCandidate reports whether the file can be matched.
+func (a *Analyzer) isCandidate(info os.FileInfo) bool {
+	if isSymlink(info) {
+		return a.Symlinks || a.RelocateLinks
+	}
+	// Ignore empty files as they add a lot of unnecessary noise to the
+	// duplicate detection and output.
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return false
+	}
+	if a.MinSize > 0 && info.Size() < a.MinSize {
+		return false
+	}
+	return a.MaxSize <= 0 || info.Size() <= a.MaxSize
+}
+
+// A walker holds the state shared by the folders of a walk.
+type walker struct {
+	*Analyzer
+	root     string
+	f        *filter
+	visitDir func(path string, info os.FileInfo) bool
+	// The device of root, when the walk stays on its filesystem.
+	dev   uint64
+	oneFS bool
+	// The real path of root, when the followed links cannot lead out of it.
+	realRoot string
+}
+
+// walk calls visit for every candidate file in root that is not filtered out.
+// The path passed to visit is relative to root so that 'root' does not get
+// stored in fileID.path. Excluded folders are not walked. If visitDir is not
+// nil, it is called for every folder to walk, root included, and the folder is
+// skipped if it returns false.
+func (a *Analyzer) walk(root string, visitDir func(path string, info os.FileInfo) bool, visit func(path string, info os.FileInfo)) error {
+	f, err := newFilter(a.Include, a.Exclude, a.Log)
+	if err != nil {
+		return err
+	}
+	return a.walkWith(&walker{Analyzer: a, root: root, f: f, visitDir: visitDir}, visit)
+}
+
+// walkTarget is like walk, but the symbolic links leading out of root are not
+// followed: the files found there could not be renamed within TARGET.
+func (a *Analyzer) walkTarget(root string, visitDir func(path string, info os.FileInfo) bool, visit func(path string, info os.FileInfo)) error {
+	f, err := newFilter(a.Include, a.Exclude, a.Log)
+	if err != nil {
+		return err
+	}
+	w := &walker{Analyzer: a, root: root, f: f, visitDir: visitDir}
+	if a.Follow {
+		if w.realRoot, err = filepath.EvalSymlinks(root); err != nil {
+			return err
+		}
+	}
+	return a.walkWith(w, visit)
+}
+
+// walkWith calls visit for every candidate file of the walk 'w', see walk.
+func (a *Analyzer) walkWith(w *walker, visit func(path string, info os.FileInfo)) error {
+	root, f, visitDir := w.root, w.f, w.visitDir
+	var chain *dirChain
+	if a.Follow || a.OneFileSystem || visitDir != nil {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if visitDir != nil && !visitDir(".", info) {
+			return nil
+		}
+		if a.Follow {
+			id, err := identify(root, info)
+			if err != nil {
+				return err
+			}
+			chain = &dirChain{id: id}
+		}
+		// Where devices are not supported, the walk is not restricted.
+		w.dev, _, w.oneFS = fileIdentity(info)
+		w.oneFS = w.oneFS && a.OneFileSystem
+	}
+
+	if a.Jobs > 1 {
+		a.visitParallel(w.walkParallel(chain), visit)
+		return nil
+	}
+
+	// Folders are walked depth-first in lexical order, like filepath.Walk.
+	// Read errors are reported and do not stop the walk.
+	var walkDir func(dir string, parent ignoreRules, chain *dirChain)
+	walkDir = func(dir string, parent ignoreRules, chain *dirChain) {
+		rules := f.rules(root, dir, parent)
+		for _, e := range w.readDir(dir, rules, chain) {
+			if e.info.IsDir() {
+				walkDir(e.path, rules, e.chain)
+			} else {
+				visit(e.path, e.info)
+			}
+		}
+	}
+	walkDir(".", nil, chain)
+	return nil
+}
+
+// A walkEntry is a file or a folder to walk.
+type walkEntry struct {
+	path string
+	info os.FileInfo
+	// For folders, when following symbolic links.
+	chain *dirChain
+}
+
+// readDir returns the candidate files and the folders of 'dir' that are
+// selected by 'rules', in lexical order. If Follow is set, symbolic links to
+// folders are returned as folders, unless they lead back to a folder of
+// 'chain' or out of the root of a TARGET walk. If OneFileSystem is set,
+// folders on other devices are skipped.
+func (w *walker) readDir(dir string, rules ignoreRules, chain *dirChain) []walkEntry {
+	infos, err := ioutil.ReadDir(filepath.Join(w.root, dir))
+	if err != nil {
+		logf(w.Log, "%v", err)
+	}
+
+	var entries []walkEntry
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		var real string
+		if w.Follow && isSymlink(info) {
+			info, real = w.follow(w.root, path, info)
+		}
+		if !info.IsDir() {
+			if w.isCandidate(info) && !w.f.skip(rules, path, false) {
+				entries = append(entries, walkEntry{path: path, info: info})
+			}
+			continue
+		}
+		if w.f.skip(rules, path, true) {
+			continue
+		}
+		if dev, _, _ := fileIdentity(info); w.oneFS && dev != w.dev {
+			logf(w.Log, "Mount point, skip '%v'", path)
+			continue
+		}
+		e := walkEntry{path: path, info: info}
+		if w.Follow {
+			id, err := identify(filepath.Join(w.root, path), info)
+			if err != nil {
+				logf(w.Log, "%v", err)
+				continue
+			}
+			if chain.contains(id) {
+				logf(w.Log, "Folder loop, skip '%v'", path)
+				continue
+			}
+			e.chain = &dirChain{id: id, parent: chain}
+		}
+		if w.visitDir != nil && !w.visitDir(path, info) {
+			continue
+		}
+		if real != "" && w.realRoot != "" && !within(w.realRoot, real) {
+			logf(w.Log, "Link out of TARGET, skip '%v'", path)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// walkParallel returns the candidate files of the walk. Folders are read
+// concurrently by Jobs goroutines, so the result is sorted afterwards in the
+// order of a sequential walk.
+func (w *walker) walkParallel(chain *dirChain) []walkEntry {
+	var (
+		mu    sync.Mutex
+		files []walkEntry
+		wg    sync.WaitGroup
+	)
+	sem := make(chan struct{}, w.Jobs)
+
+	var walkDir func(dir string, parent ignoreRules, chain *dirChain)
+	walkDir = func(dir string, parent ignoreRules, chain *dirChain) {
+		defer wg.Done()
+		sem <- struct{}{}
+		rules := w.f.rules(w.root, dir, parent)
+		entries := w.readDir(dir, rules, chain)
+		<-sem
+
+		var local []walkEntry
+		for _, e := range entries {
+			if e.info.IsDir() {
+				wg.Add(1)
+				go walkDir(e.path, rules, e.chain)
+			} else {
+				local = append(local, e)
+			}
+		}
+
+		mu.Lock()
+		files = append(files, local...)
+		mu.Unlock()
+	}
+
+	wg.Add(1)
+	go walkDir(".", nil, chain)
+	wg.Wait()
+
+	sort.Slice(files, func(i, j int) bool { return walkLess(files[i].path, files[j].path) })
+	return files
+}
+
+// walkLess reports whether a sequential walk visits 'a' before 'b'. Folders are
+// walked depth-first in lexical order, so paths must be compared element by
+// element: "a/b" comes before "a.b".
+func walkLess(a, b string) bool {
+	for {
+		i := strings.IndexByte(a, os.PathSeparator)
+		j := strings.IndexByte(b, os.PathSeparator)
+		ea, eb := a, b
+		if i >= 0 {
+			ea = a[:i]
+		}
+		if j >= 0 {
+			eb = b[:j]
+		}
+		if ea != eb || i < 0 || j < 0 {
+			if ea == eb {
+				// One path is a prefix of the other, or they are equal.
+				return i < 0 && j >= 0
+			}
+			return ea < eb
+		}
+		a, b = a[i+1:], b[j+1:]
+	}
+}
+
+// visitParallel calls visit for all files with a.Jobs goroutines. Files of the
+// same size are visited by the same goroutine, in order: since the conflicts
+// can only arise between files of the same size, the result is the same as
+// for a sequential visit.
+func (a *Analyzer) visitParallel(files []walkEntry, visit func(path string, info os.FileInfo)) {
+	var sizes []int64
+	groups := make(map[int64][]walkEntry)
+	for _, f := range files {
+		size := f.info.Size()
+		if _, ok := groups[size]; !ok {
+			sizes = append(sizes, size)
+		}
+		groups[size] = append(groups[size], f)
+	}
+
+	queue := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < a.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for size := range queue {
+				for _, f := range groups[size] {
+					visit(f.path, f.info)
+				}
+			}
+		}()
+	}
+	for _, size := range sizes {
+		queue <- size
+	}
+	close(queue)
+	wg.Wait()
+}
@@ -0,0 +1,167 @@
+// Copyright © 2015-2016 Pierre Neidhardt <ambrevar@gmail.com>
+// Use of this file is governed by the license that can be found in LICENSE.
+
+package hsync
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// xxHash64 is a fast non-cryptographic hash. See
+// https://github.com/Cyan4973/xxHash for the specification.
+// The seed is always 0.
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+
+	xxMagic         = "xxh64\x01"
+	xxMarshaledSize = len(xxMagic) + 4*8 + 8 + 32 + 1
+)
+
+type xxHash64 struct {
+	v     [4]uint64
+	total uint64
+	mem   [32]byte
+	n     int // Number of bytes used in 'mem'.
+}
+
+func newXXHash64() *xxHash64 {
+	d := &xxHash64{}
+	d.Reset()
+	return d
+}
+
+func (d *xxHash64) Reset() {
+	// Constant arithmetic would overflow, so wrap around at run time.
+	p1, p2 := xxPrime1, xxPrime2
+	d.v[0] = p1 + p2
+	d.v[1] = p2
+	d.v[2] = 0
+	d.v[3] = -p1
+	d.total = 0
+	d.n = 0
+}
+
+func (d *xxHash64) Size() int      { return 8 }
+func (d *xxHash64) BlockSize() int { return 32 }
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (d *xxHash64) stripe(b []byte) {
+	d.v[0] = xxRound(d.v[0], binary.LittleEndian.Uint64(b[0:8]))
+	d.v[1] = xxRound(d.v[1], binary.LittleEndian.Uint64(b[8:16]))
+	d.v[2] = xxRound(d.v[2], binary.LittleEndian.Uint64(b[16:24]))
+	d.v[3] = xxRound(d.v[3], binary.LittleEndian.Uint64(b[24:32]))
+}
+
+func (d *xxHash64) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+
+	if d.n+len(b) < 32 {
+		d.n += copy(d.mem[d.n:], b)
+		return n, nil
+	}
+
+	if d.n > 0 {
+		c := copy(d.mem[d.n:], b)
+		d.stripe(d.mem[:])
+		b = b[c:]
+		d.n = 0
+	}
+
+	for ; len(b) >= 32; b = b[32:] {
+		d.stripe(b)
+	}
+	d.n = copy(d.mem[:], b)
+	return n, nil
+}
+
+func (d *xxHash64) Sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		h = bits.RotateLeft64(d.v[0], 1) + bits.RotateLeft64(d.v[1], 7) +
+			bits.RotateLeft64(d.v[2], 12) + bits.RotateLeft64(d.v[3], 18)
+		for _, v := range d.v {
+			h = xxMergeRound(h, v)
+		}
+	} else {
+		h = d.v[2] + xxPrime5
+	}
+	h += d.total
+
+	b := d.mem[:d.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+// Sum appends the canonical (big-endian) representation of the digest.
+func (d *xxHash64) Sum(b []byte) []byte {
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], d.Sum64())
+	return append(b, s[:]...)
+}
+
+func (d *xxHash64) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, xxMarshaledSize)
+	b = append(b, xxMagic...)
+	for _, v := range d.v {
+		b = binary.BigEndian.AppendUint64(b, v)
+	}
+	b = binary.BigEndian.AppendUint64(b, d.total)
+	b = append(b, d.mem[:]...)
+	b = append(b, byte(d.n))
+	return b, nil
+}
+
+func (d *xxHash64) UnmarshalBinary(b []byte) error {
+	if len(b) != xxMarshaledSize || string(b[:len(xxMagic)]) != xxMagic {
+		return errors.New("xxhash: invalid hash state")
+	}
+	b = b[len(xxMagic):]
+	for i := range d.v {
+		d.v[i] = binary.BigEndian.Uint64(b)
+		b = b[8:]
+	}
+	d.total = binary.BigEndian.Uint64(b)
+	b = b[8:]
+	copy(d.mem[:], b[:32])
+	d.n = int(b[32])
+	if d.n >= 32 {
+		return errors.New("xxhash: invalid hash state")
+	}
+	return nil
+}
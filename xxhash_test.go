@@ -0,0 +1,50 @@
+package hsync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXXHash64(t *testing.T) {
+	cases := []struct {
+		input string
+		want  uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{strings.Repeat("0123456789", 20), 0x2561e865c1554c7e},
+	}
+
+	for _, c := range cases {
+		d := newXXHash64()
+		d.Write([]byte(c.input))
+		if got := d.Sum64(); got != c.want {
+			t.Errorf("xxhash(%q) = %x, want %x", c.input, got, c.want)
+		}
+	}
+
+	// Compare incremental writes and marshaled states with a one-shot digest.
+	input := strings.Repeat("0123456789", 20)
+	d := newXXHash64()
+	d.Write([]byte(input))
+	want := d.Sum64()
+	for _, step := range []int{1, 7, 31, 32, 33} {
+		d := newXXHash64()
+		for i := 0; i < len(input); i += step {
+			end := i + step
+			if end > len(input) {
+				end = len(input)
+			}
+			state, _ := d.MarshalBinary()
+			d = newXXHash64()
+			if err := d.UnmarshalBinary(state); err != nil {
+				t.Fatal(err)
+			}
+			d.Write([]byte(input[i:end]))
+		}
+		if got := d.Sum64(); got != want {
+			t.Errorf("step %v: got %x, want %x", step, got, want)
+		}
+	}
+}